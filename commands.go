@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mengqiy/runc-poc/images"
+)
+
+// runCommand runs the store maintenance command named by args, e.g.
+// "store gc".
+func runCommand(ctx context.Context, store *images.Store, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: %s <group> <command> [flags]", os.Args[0])
+	}
+	group, command, args := args[0], args[1], args[2:]
+	switch group + " " + command {
+	case "images ls":
+		return runList(ctx, store, args)
+	case "images export":
+		return runExport(ctx, store, args)
+	case "images import":
+		return runImport(ctx, store, args)
+	case "images inspect":
+		return runInspect(ctx, store, args)
+	case "images pull":
+		return runPull(ctx, store, args)
+	case "images rm":
+		return runRemove(ctx, store, args)
+	case "store fsck":
+		return runFsck(ctx, store, args)
+	case "store gc":
+		return runGC(ctx, store, args)
+	default:
+		return fmt.Errorf("unknown command %q", group+" "+command)
+	}
+}
+
+func runGC(ctx context.Context, store *images.Store, args []string) error {
+	var policy images.GCPolicy
+	flags := flag.NewFlagSet("store gc", flag.ExitOnError)
+	flags.Int64Var(&policy.MaxBytes, "max-bytes", 0, "evict least recently used images until the store uses at most this many bytes")
+	flags.DurationVar(&policy.MaxAge, "max-age", 0, "evict images not used for longer than this")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	result, err := store.GC(ctx, policy)
+	if err != nil {
+		return err
+	}
+	for _, image := range result.RemovedImages {
+		fmt.Printf("evicted %s\n", image)
+	}
+	fmt.Printf("removed %d paths, reclaimed %d bytes\n", len(result.RemovedPaths), result.ReclaimedBytes)
+	return nil
+}
+
+func runList(ctx context.Context, store *images.Store, args []string) error {
+	flags := flag.NewFlagSet("images ls", flag.ExitOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	summaries, err := store.List(ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPLATFORM\tDIGEST\tSIZE\tLAST USED\tEXTRACTED")
+	for _, summary := range summaries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", summary.Name, summary.Platform, summary.Digest, summary.Size, summary.LastUsed.Format(time.RFC3339), summary.ExtractedDir)
+	}
+	return w.Flush()
+}
+
+func runInspect(ctx context.Context, store *images.Store, args []string) error {
+	flags := flag.NewFlagSet("images inspect", flag.ExitOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: images inspect <name|digest>")
+	}
+
+	details, err := store.Inspect(ctx, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(details, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+func runRemove(ctx context.Context, store *images.Store, args []string) error {
+	flags := flag.NewFlagSet("images rm", flag.ExitOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: images rm <name|digest>...")
+	}
+
+	for _, arg := range flags.Args() {
+		removed, err := store.Remove(ctx, arg)
+		for _, image := range removed {
+			fmt.Printf("removed %s\n", image)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runFsck(ctx context.Context, store *images.Store, args []string) error {
+	flags := flag.NewFlagSet("store fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "remove the inconsistent files and directories")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	report, err := store.Fsck(ctx, *repair)
+	if err != nil {
+		return err
+	}
+	for _, problem := range report.Problems {
+		status := "found"
+		if problem.Repaired {
+			status = "repaired"
+		}
+		fmt.Printf("%s: %s: %s\n", status, problem.Path, problem.Description)
+	}
+	if len(report.Problems) != 0 && !*repair {
+		return fmt.Errorf("found %d problems, run with --repair to fix them", len(report.Problems))
+	}
+	return nil
+}
+
+func runImport(ctx context.Context, store *images.Store, args []string) error {
+	flags := flag.NewFlagSet("images import", flag.ExitOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: images import <oci-layout-dir|docker-save-tarball>...")
+	}
+
+	for _, arg := range flags.Args() {
+		imported, err := store.Import(ctx, arg)
+		for _, image := range imported {
+			fmt.Printf("imported %s\n", image)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runExport(ctx context.Context, store *images.Store, args []string) error {
+	flags := flag.NewFlagSet("images export", flag.ExitOnError)
+	output := flags.String("output", "", "the bundle to write")
+	format := flags.String("format", string(images.ExportLayout), "the bundle format: oci for an OCI layout directory, tar for a tarball of one")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *output == "" || flags.NArg() == 0 {
+		return fmt.Errorf("usage: images export --output <bundle> [--format oci|tar] <name|digest>...")
+	}
+
+	exported, err := store.Export(ctx, *output, images.ExportFormat(*format), flags.Args())
+	if err != nil {
+		return err
+	}
+	for _, image := range exported {
+		fmt.Printf("exported %s\n", image)
+	}
+	return nil
+}
+
+func runPull(ctx context.Context, store *images.Store, args []string) error {
+	flags := flag.NewFlagSet("images pull", flag.ExitOnError)
+	platform := flags.String("platform", "", "the platform to pull, as os/architecture[/variant] (default the host's)")
+	policy := flags.String("pull-policy", "", "the pull policy: Always, IfNotPresent, Never or CheckDigest")
+	progress := flags.String("progress", "bar", "how to show progress: bar, json (JSON lines on stdout) or none")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: images pull [--platform os/arch[/variant]] [--progress bar|json|none] <name>")
+	}
+
+	opts := []images.ExtractOption{images.WithPullPolicy(images.PullPolicy(*policy))}
+	if *platform != "" {
+		p, err := images.ParsePlatform(*platform)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, images.WithPlatform(p))
+	}
+	switch *progress {
+	case "bar":
+		opts = append(opts, images.WithProgress(images.NewProgressBar(os.Stderr)))
+	case "json":
+		opts = append(opts, images.WithProgress(images.NewJSONProgress(os.Stdout)))
+	case "none":
+	default:
+		return fmt.Errorf("unknown progress format %q", *progress)
+	}
+
+	extracted, err := store.Extract(ctx, flags.Arg(0), opts...)
+	if err != nil {
+		return err
+	}
+	if *progress != "json" {
+		fmt.Println(extracted.ExtractedDir)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package images
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/docker/cli/cli/config"
+	dockertypes "github.com/docker/cli/cli/config/types"
+	"github.com/docker/docker-credential-helpers/client"
+	"github.com/docker/docker-credential-helpers/credentials"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// WithKeychain adds a keychain to resolve registry credentials with. Keychains
+// are consulted in the order they are added, after the static credentials and
+// credential helpers of the store, and before authn.DefaultKeychain.
+func WithKeychain(keychain authn.Keychain) Option {
+	return func(s *Store) {
+		s.keychains = append(s.keychains, keychain)
+	}
+}
+
+// WithDockerConfig adds the credentials of the docker config.json file at
+// path, including the credential helpers it configures.
+func WithDockerConfig(path string) Option {
+	return WithKeychain(&dockerConfigKeychain{path: path})
+}
+
+// WithBasicAuth makes the store log in to registry with a username and
+// password.
+func WithBasicAuth(registry string, username, password string) Option {
+	return withStaticAuth(registry, &authn.Basic{
+		Username: username,
+		Password: password,
+	})
+}
+
+// WithBearerToken makes the store log in to registry with a bearer token.
+func WithBearerToken(registry string, token string) Option {
+	return withStaticAuth(registry, &authn.Bearer{
+		Token: token,
+	})
+}
+
+func withStaticAuth(registry string, auth authn.Authenticator) Option {
+	return func(s *Store) {
+		s.credentials[registryKey(registry)] = auth
+	}
+}
+
+// WithCredentialHelper makes the store get the credentials for registry from
+// the docker-credential-<helper> program.
+func WithCredentialHelper(registry string, helper string) Option {
+	return func(s *Store) {
+		s.credentialHelpers[registryKey(registry)] = helper
+	}
+}
+
+// registryKey spells Docker Hub the way name.Registry does.
+func registryKey(registry string) string {
+	if registry == "docker.io" {
+		return name.DefaultRegistry
+	}
+	return registry
+}
+
+// keychain returns the keychain the store resolves registry credentials with.
+func (s *Store) keychain() authn.Keychain {
+	keychains := []authn.Keychain{
+		&storeKeychain{
+			credentials:       s.credentials,
+			credentialHelpers: s.credentialHelpers,
+		},
+	}
+	keychains = append(keychains, s.keychains...)
+	keychains = append(keychains, authn.DefaultKeychain)
+	return authn.NewMultiKeychain(keychains...)
+}
+
+// storeKeychain resolves the static credentials and credential helpers
+// configured per registry.
+type storeKeychain struct {
+	credentials       map[string]authn.Authenticator
+	credentialHelpers map[string]string
+}
+
+func (k *storeKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	if auth, ok := k.credentials[target.RegistryStr()]; ok {
+		return auth, nil
+	}
+	if helper, ok := k.credentialHelpers[target.RegistryStr()]; ok {
+		return credentialHelperAuth(helper, target.RegistryStr())
+	}
+	return authn.Anonymous, nil
+}
+
+// credentialHelperAuth gets the credentials for registry from the
+// docker-credential-<helper> program.
+func credentialHelperAuth(helper string, registry string) (authn.Authenticator, error) {
+	creds, err := client.Get(client.NewShellProgramFunc("docker-credential-"+helper), registry)
+	if credentials.IsErrCredentialsNotFound(err) {
+		return authn.Anonymous, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting credentials for %s from docker-credential-%s: %w", registry, helper, err)
+	}
+	// Credential helpers return identity tokens with this username.
+	if creds.Username == "<token>" {
+		return authn.FromConfig(authn.AuthConfig{IdentityToken: creds.Secret}), nil
+	}
+	return &authn.Basic{Username: creds.Username, Password: creds.Secret}, nil
+}
+
+// dockerConfigKeychain resolves credentials with a docker config.json file.
+type dockerConfigKeychain struct {
+	path string
+}
+
+func (k *dockerConfigKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	f, err := os.Open(k.path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading docker config: %w", err)
+	}
+	defer f.Close()
+	cf, err := config.LoadFromReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing docker config %q: %w", k.path, err)
+	}
+
+	// Docker keeps the credentials of Docker Hub under its old URL.
+	key := target.RegistryStr()
+	if key == name.DefaultRegistry {
+		key = authn.DefaultAuthKey
+	}
+	cfg, err := cf.GetAuthConfig(key)
+	if err != nil {
+		return nil, fmt.Errorf("error getting credentials for %s from docker config %q: %w", target.RegistryStr(), k.path, err)
+	}
+	if cfg == (dockertypes.AuthConfig{}) {
+		return authn.Anonymous, nil
+	}
+	return authn.FromConfig(authn.AuthConfig{
+		Username:      cfg.Username,
+		Password:      cfg.Password,
+		Auth:          cfg.Auth,
+		IdentityToken: cfg.IdentityToken,
+		RegistryToken: cfg.RegistryToken,
+	}), nil
+}
@@ -0,0 +1,64 @@
+package images
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	cranev1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// blobsDir keeps the manifests and configs of the images in the store, which
+// the layer cache does not hold.
+func (s *Store) blobsDir() string {
+	return filepath.Join(s.baseDir, "blobs")
+}
+
+func (s *Store) blobPath(h cranev1.Hash) string {
+	return filepath.Join(s.blobsDir(), h.Algorithm, h.Hex)
+}
+
+// saveBlobs writes the manifest and config of img to the blobs directory and
+// returns the digest of the config.
+func (s *Store) saveBlobs(img cranev1.Image) (cranev1.Hash, error) {
+	manifest, err := img.RawManifest()
+	if err != nil {
+		return cranev1.Hash{}, fmt.Errorf("error getting manifest of image: %w", err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return cranev1.Hash{}, fmt.Errorf("error getting digest of image: %w", err)
+	}
+	if err := s.writeBlob(digest, manifest); err != nil {
+		return cranev1.Hash{}, err
+	}
+
+	config, err := img.RawConfigFile()
+	if err != nil {
+		return cranev1.Hash{}, fmt.Errorf("error getting config of image: %w", err)
+	}
+	configDigest, err := img.ConfigName()
+	if err != nil {
+		return cranev1.Hash{}, fmt.Errorf("error getting config digest of image: %w", err)
+	}
+	if err := s.writeBlob(configDigest, config); err != nil {
+		return cranev1.Hash{}, err
+	}
+	return configDigest, nil
+}
+
+func (s *Store) writeBlob(h cranev1.Hash, b []byte) error {
+	p := s.blobPath(h)
+	if _, err := os.Stat(p); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return fmt.Errorf("failed to create directory %q: %w", filepath.Dir(p), err)
+	}
+	return writeFileAtomic(p, b, 0644)
+}
+
+func (s *Store) readBlob(h cranev1.Hash) ([]byte, error) {
+	return ioutil.ReadFile(s.blobPath(h))
+}
@@ -0,0 +1,367 @@
+package images
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	cranev1 "github.com/google/go-containerregistry/pkg/v1"
+	"golang.org/x/sys/unix"
+
+	"k8s.io/klog/v2"
+)
+
+// DedupMode is how files with the same contents in different layers share
+// their storage.
+type DedupMode string
+
+const (
+	// DedupNone keeps a copy of each file per layer.
+	DedupNone DedupMode = ""
+	// DedupHardLink hard-links identical files, with the same contents, mode,
+	// owner and modification time, to a shared object.
+	DedupHardLink DedupMode = "hardlink"
+	// DedupReflink makes identical files reflinks (FICLONE) of a shared
+	// object, so that they share their data but not their inode. Where the
+	// filesystem has no reflinks, it falls back to DedupHardLink.
+	DedupReflink DedupMode = "reflink"
+)
+
+// WithDedup makes the store deduplicate the regular files of the layers it
+// unpacks through an object pool, so that images built on the same base
+// store its files once even when their layers differ. Files with xattrs are
+// left alone.
+func WithDedup(mode DedupMode) Option {
+	return func(s *Store) {
+		s.dedup = mode
+	}
+}
+
+// poolDir holds the object pool: the shared objects, as objects/<algorithm>/
+// <hex>, and for each unpacked layer the objects it uses, as layers/
+// <algorithm>/<hex> keyed by diffID. GC removes the objects which no layer
+// uses any more.
+func (s *Store) poolDir() string {
+	return filepath.Join(s.baseDir, "pool")
+}
+
+func (s *Store) poolObjectsDir() string {
+	return filepath.Join(s.poolDir(), "objects")
+}
+
+func (s *Store) poolRefsDir() string {
+	return filepath.Join(s.poolDir(), "layers")
+}
+
+// poolObjects returns the objects of the pool which the given layers use.
+func (s *Store) poolObjects(layers map[string]bool) (map[string]bool, error) {
+	objects := map[string]bool{}
+	for layer := range layers {
+		diffID, err := cranev1.NewHash(layer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid layer %q: %w", layer, err)
+		}
+		p := filepath.Join(s.poolRefsDir(), diffID.Algorithm, diffID.Hex)
+		b, err := ioutil.ReadFile(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading objects of layer %s: %w", diffID, err)
+		}
+		var refs []string
+		if err := json.Unmarshal(b, &refs); err != nil {
+			return nil, fmt.Errorf("error parsing objects of layer %s: %w", diffID, err)
+		}
+		for _, object := range refs {
+			objects[object] = true
+		}
+	}
+	return objects, nil
+}
+
+// objectPool deduplicates the files of layers being unpacked.
+type objectPool struct {
+	objectsDir string
+	refsDir    string
+	mode       DedupMode
+
+	// noReflink is set once the filesystem turned out not to support
+	// reflinks.
+	noReflink int32
+}
+
+func (p *objectPool) objectPath(h cranev1.Hash) string {
+	return filepath.Join(p.objectsDir, h.Algorithm, h.Hex)
+}
+
+// dedup replaces the regular files under dir with links to objects of the
+// pool, adding the objects which are not there yet, and returns the objects
+// used. Files which cannot be deduplicated are left as they are.
+func (p *objectPool) dedup(dir string) ([]cranev1.Hash, error) {
+	type inode struct {
+		dev uint64
+		ino uint64
+	}
+	// Hard links within the layer are added once, and the other names of
+	// the inode then share its object too. A zero hash marks an inode which
+	// was not deduplicated.
+	seen := map[inode]cranev1.Hash{}
+	used := map[cranev1.Hash]bool{}
+	var objects []cranev1.Hash
+
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || fi.Size() == 0 {
+			return nil
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+		key := inode{dev: uint64(st.Dev), ino: st.Ino}
+		if h, ok := seen[key]; ok {
+			// A reflink replaces the data of the inode, which all its names
+			// share already, but a hard link only replaces the first name.
+			if h == (cranev1.Hash{}) || p.reflinks() {
+				return nil
+			}
+			if err := p.replace(path, fi, p.objectPath(h)); err != nil {
+				klog.V(2).Infof("not deduplicating %q: %v", path, err)
+			}
+			return nil
+		}
+
+		h, err := p.add(path, fi)
+		if err != nil {
+			klog.V(2).Infof("not deduplicating %q: %v", path, err)
+			seen[key] = cranev1.Hash{}
+			return nil
+		}
+		seen[key] = h
+		if !used[h] {
+			used[h] = true
+			objects = append(objects, h)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to deduplicate %q: %w", dir, err)
+	}
+	return objects, nil
+}
+
+// writeRefs records the objects the layer with the given diffID uses. It must
+// be written before the layer is renamed into place, so that GC never sees a
+// layer without it.
+func (p *objectPool) writeRefs(diffID cranev1.Hash, objects []cranev1.Hash) error {
+	refs := []string{}
+	for _, object := range objects {
+		refs = append(refs, object.String())
+	}
+	b, err := json.Marshal(refs)
+	if err != nil {
+		return fmt.Errorf("error converting objects of layer %s to json: %w", diffID, err)
+	}
+	path := filepath.Join(p.refsDir, diffID.Algorithm, diffID.Hex)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory %q: %w", filepath.Dir(path), err)
+	}
+	return writeFileAtomic(path, b, 0644)
+}
+
+// add makes the file at path share the object of the pool with its contents
+// and metadata, and returns the hash of the object.
+func (p *objectPool) add(path string, fi os.FileInfo) (cranev1.Hash, error) {
+	if hasXattrs(path) {
+		return cranev1.Hash{}, errors.New("file has xattrs")
+	}
+	h, err := objectHash(path, fi)
+	if err != nil {
+		return cranev1.Hash{}, err
+	}
+	object := p.objectPath(h)
+	if err := os.MkdirAll(filepath.Dir(object), 0755); err != nil {
+		return cranev1.Hash{}, fmt.Errorf("failed to create directory %q: %w", filepath.Dir(object), err)
+	}
+
+	if _, err := os.Lstat(object); os.IsNotExist(err) {
+		err := p.create(path, fi, object)
+		if err == nil {
+			return h, nil
+		}
+		// Another layer being unpacked may have just added it.
+		if !os.IsExist(err) {
+			return cranev1.Hash{}, err
+		}
+	}
+	return h, p.replace(path, fi, object)
+}
+
+// create adds the file at path to the pool as object.
+func (p *objectPool) create(path string, fi os.FileInfo, object string) error {
+	if p.reflinks() {
+		err := p.cloneObject(path, fi, object)
+		if !p.reflinkUnsupported(err) {
+			return err
+		}
+	}
+	return os.Link(path, object)
+}
+
+// cloneObject makes object a reflink of the file at path, with the same
+// metadata.
+func (p *objectPool) cloneObject(path string, fi os.FileInfo, object string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(object), "kontained")
+	if err != nil {
+		return fmt.Errorf("failed to create tempfile for %q: %w", object, err)
+	}
+	defer os.Remove(tmp.Name())
+	err = clone(tmp, path)
+	if closeErr := tmp.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := copyMetadata(path, tmp.Name(), fi); err != nil {
+		return err
+	}
+	// Unlike a rename, linking fails if the object is already there.
+	return os.Link(tmp.Name(), object)
+}
+
+// replace makes the file at path share the data of object, which has the
+// same contents and metadata.
+func (p *objectPool) replace(path string, fi os.FileInfo, object string) error {
+	if p.reflinks() {
+		err := p.cloneInto(path, fi, object)
+		if !p.reflinkUnsupported(err) {
+			return err
+		}
+	}
+
+	// The object may have been made with reflinks, which do not copy the
+	// owner without privileges, so check it is the same before sharing its
+	// inode.
+	objectInfo, err := os.Lstat(object)
+	if err != nil {
+		return err
+	}
+	if os.SameFile(fi, objectInfo) {
+		return nil
+	}
+	if !sameMetadata(fi, objectInfo) {
+		return fmt.Errorf("object %q has different metadata", object)
+	}
+	tmp := filepath.Join(filepath.Dir(path), "kontained-"+filepath.Base(object))
+	if err := os.Link(object, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// cloneInto replaces the data of the file at path with a reflink of object,
+// keeping its metadata.
+func (p *objectPool) cloneInto(path string, fi os.FileInfo, object string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = clone(f, object)
+	if closeErr := f.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	return applyTimes(path, time.Unix(st.Atim.Unix()), fi.ModTime())
+}
+
+func (p *objectPool) reflinks() bool {
+	return p.mode == DedupReflink && atomic.LoadInt32(&p.noReflink) == 0
+}
+
+// reflinkUnsupported returns whether err says that the filesystem does not
+// do reflinks, and if so stops trying them.
+func (p *objectPool) reflinkUnsupported(err error) bool {
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EXDEV) ||
+		errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOTTY) || errors.Is(err, unix.ENOSYS) {
+		if atomic.CompareAndSwapInt32(&p.noReflink, 0, 1) {
+			klog.Infof("reflinks are not supported in %s, using hard links: %v", p.objectsDir, err)
+		}
+		return true
+	}
+	return false
+}
+
+// clone makes dest a reflink of the file at src.
+func clone(dest *os.File, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := unix.IoctlFileClone(int(dest.Fd()), int(in.Fd())); err != nil {
+		return fmt.Errorf("failed to clone %q: %w", src, err)
+	}
+	return nil
+}
+
+// objectHash returns the hash of the contents and metadata of a file, which
+// names its object in the pool.
+func objectHash(path string, fi os.FileInfo) (cranev1.Hash, error) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return cranev1.Hash{}, fmt.Errorf("unable to get owner of %q", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return cranev1.Hash{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%o %d %d %d\x00", fi.Mode(), st.Uid, st.Gid, fi.ModTime().UnixNano())
+	if _, err := io.Copy(h, f); err != nil {
+		return cranev1.Hash{}, fmt.Errorf("error reading %q: %w", path, err)
+	}
+	return cranev1.Hash{Algorithm: "sha256", Hex: fmt.Sprintf("%x", h.Sum(nil))}, nil
+}
+
+// sameMetadata returns whether two files have the metadata which objects are
+// keyed by.
+func sameMetadata(a, b os.FileInfo) bool {
+	sa, ok := a.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	sb, ok := b.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	return a.Mode() == b.Mode() && sa.Uid == sb.Uid && sa.Gid == sb.Gid && a.ModTime().Equal(b.ModTime())
+}
+
+func hasXattrs(path string) bool {
+	size, err := unix.Llistxattr(path, nil)
+	if errors.Is(err, unix.ENOTSUP) {
+		return false
+	}
+	return err != nil || size > 0
+}
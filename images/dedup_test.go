@@ -0,0 +1,220 @@
+package images
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"golang.org/x/sys/unix"
+)
+
+// writeFiles writes the files of an unpacked layer under dir, all with the
+// same contents and metadata, and hard-links links[name] to name.
+func writeFiles(t *testing.T, dir string, names []string, links map[string]string) {
+	t.Helper()
+	mtime := time.Unix(1600000000, 0)
+	for _, name := range names {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte("shared"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range links {
+		p := filepath.Join(dir, link)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Link(filepath.Join(dir, target), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func sameFile(t *testing.T, a, b string) bool {
+	t.Helper()
+	ai, err := os.Lstat(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bi, err := os.Lstat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return os.SameFile(ai, bi)
+}
+
+func TestDedupHardLinkedNames(t *testing.T) {
+	for _, mode := range []DedupMode{DedupHardLink, DedupReflink} {
+		t.Run(string(mode), func(t *testing.T) {
+			dir := t.TempDir()
+			pool := &objectPool{
+				objectsDir: filepath.Join(dir, "pool", "objects"),
+				refsDir:    filepath.Join(dir, "pool", "layers"),
+				mode:       mode,
+			}
+			// The first layer adds the object, which the names of the
+			// hard-linked file in the second layer are then replaced with.
+			first := filepath.Join(dir, "first")
+			writeFiles(t, first, []string{"a"}, nil)
+			second := filepath.Join(dir, "second")
+			names := []string{"x", "y", "sub/z"}
+			writeFiles(t, second, []string{"x"}, map[string]string{"y": "x", "sub/z": "x"})
+
+			firstObjects, err := pool.dedup(first)
+			if err != nil {
+				t.Fatal(err)
+			}
+			secondObjects, err := pool.dedup(second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(firstObjects) != 1 || len(secondObjects) != 1 || firstObjects[0] != secondObjects[0] {
+				t.Fatalf("layers use objects %v and %v, want the same single object", firstObjects, secondObjects)
+			}
+			object := pool.objectPath(firstObjects[0])
+
+			for _, name := range names {
+				p := filepath.Join(second, name)
+				b, err := ioutil.ReadFile(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(b) != "shared" {
+					t.Errorf("%s has contents %q after dedup", name, b)
+				}
+				if !sameFile(t, p, filepath.Join(second, "x")) {
+					t.Errorf("%s is no longer a hard link of x", name)
+				}
+			}
+
+			if pool.reflinks() {
+				// Reflinks share the data but not the inode.
+				if sameFile(t, filepath.Join(second, "x"), object) {
+					t.Errorf("x is a hard link of the object, want a reflink")
+				}
+				return
+			}
+			if mode == DedupReflink {
+				t.Logf("reflinks are not supported, checking the fallback to hard links")
+			}
+			for _, p := range []string{filepath.Join(first, "a"), filepath.Join(second, "x"), filepath.Join(second, "y"), filepath.Join(second, "sub/z")} {
+				if !sameFile(t, p, object) {
+					t.Errorf("%s is not a hard link of the object", p)
+				}
+			}
+		})
+	}
+}
+
+func TestDedupReflinkFallback(t *testing.T) {
+	pool := &objectPool{mode: DedupReflink}
+	if !pool.reflinks() {
+		t.Fatal("reflink pool does not try reflinks")
+	}
+	if pool.reflinkUnsupported(os.ErrNotExist) {
+		t.Error("reflinkUnsupported(ErrNotExist) = true")
+	}
+	if !pool.reflinks() {
+		t.Error("an unrelated error turned reflinks off")
+	}
+	if !pool.reflinkUnsupported(fmt.Errorf("failed to clone %q: %w", "a", unix.EOPNOTSUPP)) {
+		t.Error("reflinkUnsupported(EOPNOTSUPP) = false")
+	}
+	if pool.reflinks() {
+		t.Error("reflinks are still tried after EOPNOTSUPP")
+	}
+}
+
+// poolObjectCount returns how many objects the pool of the store at dir has.
+func poolObjectCount(t *testing.T, dir string) int {
+	t.Helper()
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "pool", "objects", "sha256"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, entry := range entries {
+		if !isTempDir(entry.Name()) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestDedupObjectsAreRemovedWithTheirLastLayer(t *testing.T) {
+	srv := httptest.NewServer(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	// Two images with different layers, sharing one file.
+	var refs []name.Reference
+	for _, repo := range []string{"a", "b"} {
+		layer := newLayer(t, entry{name: "etc/"}, entry{name: "etc/shared", contents: "shared"}, entry{name: "etc/" + repo, contents: repo})
+		img, err := mutate.AppendLayers(empty.Image, layer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := name.ParseReference(host + "/dedup/" + repo + ":v1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := remote.Write(ref, img); err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, ref)
+	}
+
+	dir := t.TempDir()
+	s, err := NewStore(dir, WithDedup(DedupHardLink))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range refs {
+		if _, err := s.Extract(context.Background(), ref.String()); err != nil {
+			t.Fatalf("Extract: %v", err)
+		}
+	}
+	if n := poolObjectCount(t, dir); n != 3 {
+		t.Fatalf("pool has %d objects after extracting both images, want 3", n)
+	}
+
+	// The shared object stays with the image still using it.
+	if _, err := s.Remove(context.Background(), refs[0].String()); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if n := poolObjectCount(t, dir); n != 2 {
+		t.Errorf("pool has %d objects after removing an image, want 2", n)
+	}
+	if _, err := s.GC(context.Background(), GCPolicy{}); err != nil {
+		t.Fatalf("GC: %v", err)
+	}
+	if n := poolObjectCount(t, dir); n != 2 {
+		t.Errorf("pool has %d objects after GC, want 2", n)
+	}
+
+	// Evicting the last image leaves no object in use.
+	if _, err := s.GC(context.Background(), GCPolicy{MaxAge: time.Nanosecond}); err != nil {
+		t.Fatalf("GC: %v", err)
+	}
+	if n := poolObjectCount(t, dir); n != 0 {
+		t.Errorf("pool has %d objects after evicting every image, want 0", n)
+	}
+}
@@ -0,0 +1,136 @@
+package images
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	cranev1 "github.com/google/go-containerregistry/pkg/v1"
+	"golang.org/x/sync/errgroup"
+)
+
+// defaultPullConcurrency is how many layers of an image are downloaded at
+// once by default, as with docker's max-concurrent-downloads.
+const defaultPullConcurrency = 3
+
+// WithPullConcurrency sets how many layers of an image are downloaded into
+// the layer cache, and unpacked, at once. It defaults to 3.
+func WithPullConcurrency(n int) Option {
+	return func(s *Store) {
+		s.pullConcurrency = n
+	}
+}
+
+// WithBandwidthLimit caps how fast the store downloads from registries, in
+// bytes per second, across all the images it is pulling. Zero, the default,
+// means no cap.
+func WithBandwidthLimit(bytesPerSecond int64) Option {
+	return func(s *Store) {
+		s.bandwidthLimit = bytesPerSecond
+	}
+}
+
+// unpackLayers unpacks the layers of an image concurrently, downloading the
+// ones which are not in the layer cache, and returns their directories in
+// order.
+func (s *Store) unpackLayers(ctx context.Context, layers []cranev1.Layer, progress *progressReporter) ([]string, error) {
+	concurrency := s.pullConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultPullConcurrency
+	}
+
+	layerDirs := make([]string, len(layers))
+	sem := make(chan struct{}, concurrency)
+	g, ctx := errgroup.WithContext(ctx)
+	for i, layer := range layers {
+		i, layer := i, layer
+		g.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			defer func() { <-sem }()
+
+			layerDir, err := s.layers.unpack(ctx, layer, newLayerProgress(progress, layer, i, len(layers)))
+			if err != nil {
+				return err
+			}
+			layerDirs[i] = layerDir
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return layerDirs, nil
+}
+
+// throttleChunk bounds the reads of a throttled response, so that the
+// limiter is consulted often enough to keep the rate even.
+const throttleChunk = 32 << 10
+
+// rateLimiter spreads reads over time so that they do not go faster than rate
+// bytes per second in total.
+type rateLimiter struct {
+	rate int64
+
+	mu sync.Mutex
+	// next is when the bytes read so far are paid for.
+	next time.Time
+}
+
+// wait blocks until n more bytes can be read.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+
+	return sleep(ctx, delay)
+}
+
+// throttledTransport reads the responses of transport no faster than limiter
+// allows.
+type throttledTransport struct {
+	transport http.RoundTripper
+	limiter   *rateLimiter
+}
+
+func (t *throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &throttledBody{
+		ReadCloser: resp.Body,
+		ctx:        req.Context(),
+		limiter:    t.limiter,
+	}
+	return resp, nil
+}
+
+type throttledBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *rateLimiter
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if waitErr := b.limiter.wait(b.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
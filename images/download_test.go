@@ -0,0 +1,93 @@
+package images
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestUnpackLayersStopsDownloadsWhenALayerFails(t *testing.T) {
+	img, err := random.Image(1000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hanging, err := layers[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing, err := layers[1].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		serving     int32
+		release     = make(chan struct{})
+		releaseOnce sync.Once
+	)
+	reg := registry.New(registry.Logger(log.New(ioutil.Discard, "", 0)))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&serving) == 1 && r.Method == http.MethodGet {
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/blobs/"+hanging.String()):
+				// Hang until the client gives up.
+				select {
+				case <-r.Context().Done():
+				case <-release:
+				}
+				return
+			case strings.HasSuffix(r.URL.Path, "/blobs/"+failing.String()):
+				http.Error(w, "gone", http.StatusNotFound)
+				return
+			}
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	// Closing the server waits for the requests it holds.
+	defer releaseOnce.Do(func() { close(release) })
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	ref, err := name.ParseReference(host + "/download/image:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&serving, 1)
+
+	s, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		_, err := s.Extract(context.Background(), ref.String())
+		errs <- err
+	}()
+	select {
+	case err := <-errs:
+		if err == nil || !strings.Contains(err.Error(), failing.String()) {
+			t.Errorf("Extract returned %v, want an error downloading layer %s", err, failing)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("Extract kept downloading a layer after another one failed")
+	}
+}
@@ -0,0 +1,384 @@
+package images
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	cranev1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"k8s.io/klog/v2"
+)
+
+// ExportFormat is the format of the bundles written by Export.
+type ExportFormat string
+
+const (
+	// ExportLayout writes an OCI image layout directory.
+	ExportLayout ExportFormat = "oci"
+	// ExportArchive writes a tarball of an OCI image layout.
+	ExportArchive ExportFormat = "tar"
+)
+
+// bundleManifestName is the file in a bundle listing the images it holds,
+// next to the index.json of the OCI layout.
+const bundleManifestName = "bundle.json"
+
+// bundleManifest lists the images of a bundle, so that Import can tell
+// whether the bundle is complete.
+type bundleManifest struct {
+	Images []bundleImage `json:"images"`
+}
+
+type bundleImage struct {
+	Name string `json:"name"`
+	// Digest is the digest of the image manifest.
+	Digest   string `json:"digest"`
+	Platform string `json:"platform,omitempty"`
+}
+
+// Export writes the images given by name or digest to a bundle at dest which
+// Import can load on a machine without access to the registry. The images
+// come from the store, except for layer blobs it did not keep, which are
+// fetched from the registry. It returns the names of the exported images.
+func (s *Store) Export(ctx context.Context, dest string, format ExportFormat, namesOrDigests []string) ([]string, error) {
+	if format != ExportLayout && format != ExportArchive {
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+	if _, err := os.Lstat(dest); err == nil {
+		return nil, fmt.Errorf("%q already exists", dest)
+	}
+
+	lock, err := s.lockStore(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	var images []*storedImage
+	seen := map[string]bool{}
+	for _, nameOrDigest := range namesOrDigests {
+		matches, err := s.findImages(nameOrDigest)
+		if err != nil {
+			return nil, err
+		}
+		for _, image := range matches {
+			if !seen[image.path] {
+				seen[image.path] = true
+				images = append(images, image)
+			}
+		}
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("no images to export")
+	}
+
+	layoutDir := dest
+	if format == ExportArchive {
+		layoutDir, err = ioutil.TempDir(filepath.Dir(dest), "kontained")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create tempdir for export: %w", err)
+		}
+		defer os.RemoveAll(layoutDir)
+	}
+
+	exported, err := s.writeBundle(ctx, layoutDir, images)
+	if err != nil {
+		if format == ExportLayout {
+			os.RemoveAll(layoutDir)
+		}
+		return nil, err
+	}
+
+	if format == ExportArchive {
+		if err := writeArchive(layoutDir, dest); err != nil {
+			return nil, err
+		}
+	}
+	return exported, nil
+}
+
+// writeBundle writes images to a new OCI layout at dir, along with the
+// bundle manifest.
+func (s *Store) writeBundle(ctx context.Context, dir string, images []*storedImage) ([]string, error) {
+	p, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		return nil, fmt.Errorf("error creating OCI layout %q: %w", dir, err)
+	}
+
+	bundle := bundleManifest{}
+	var exported []string
+	for _, image := range images {
+		klog.Infof("exporting image %s", image.info.Name)
+		ref, err := name.ParseReference(image.info.Name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid name for image %s: %w", image.info.Name, err)
+		}
+		img, err := s.storedImage(ctx, ref, image.info)
+		if err != nil {
+			return nil, err
+		}
+		// Name the image the way containerd does: the full name, and the
+		// tag or digest on its own.
+		options := []layout.Option{layout.WithAnnotations(map[string]string{
+			annotationContainerdName: ref.Name(),
+			annotationRefName:        ref.Identifier(),
+		})}
+		if image.info.Platform != "" {
+			platform, err := ParsePlatform(image.info.Platform)
+			if err != nil {
+				return nil, fmt.Errorf("image %s: %w", image.info.Name, err)
+			}
+			options = append(options, layout.WithPlatform(platform))
+		}
+		if err := p.AppendImage(img, options...); err != nil {
+			return nil, fmt.Errorf("error writing image %s to %q: %w", image.info.Name, dir, err)
+		}
+		bundle.Images = append(bundle.Images, bundleImage{
+			Name:     image.info.Name,
+			Digest:   "sha256:" + image.info.Digest,
+			Platform: image.info.Platform,
+		})
+		exported = append(exported, image.info.Name)
+	}
+
+	b, err := json.MarshalIndent(&bundle, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error converting bundle manifest to json: %w", err)
+	}
+	if err := p.WriteFile(bundleManifestName, b, 0644); err != nil {
+		return nil, fmt.Errorf("error writing bundle manifest: %w", err)
+	}
+	return exported, nil
+}
+
+// storedImage rebuilds an image from the manifest and config in the blobs
+// directory and the compressed layers in the layer cache, fetching the layers
+// which are not there from the registry of ref.
+func (s *Store) storedImage(ctx context.Context, ref name.Reference, info *cachedImage) (cranev1.Image, error) {
+	manifestDigest := cranev1.Hash{Algorithm: "sha256", Hex: info.Digest}
+	manifest, err := s.readBlob(manifestDigest)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest of image %s: %w", info.Name, err)
+	}
+	if info.ConfigDigest == "" {
+		return nil, fmt.Errorf("image %s was extracted before the store kept configs, pull it again to export it", info.Name)
+	}
+	configDigest, err := cranev1.NewHash(info.ConfigDigest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config digest %q for image %s: %w", info.ConfigDigest, info.Name, err)
+	}
+	config, err := s.readBlob(configDigest)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config of image %s: %w", info.Name, err)
+	}
+
+	return partial.CompressedToImage(&storeImage{
+		s:        s,
+		ctx:      ctx,
+		ref:      ref,
+		manifest: manifest,
+		config:   config,
+	})
+}
+
+// storeImage is an image whose manifest and config are in the store, and
+// whose layers are in the store or in the registry of ref.
+type storeImage struct {
+	s        *Store
+	ctx      context.Context
+	ref      name.Reference
+	manifest []byte
+	config   []byte
+}
+
+var _ partial.CompressedImageCore = (*storeImage)(nil)
+
+func (i *storeImage) RawConfigFile() ([]byte, error) {
+	return i.config, nil
+}
+
+func (i *storeImage) RawManifest() ([]byte, error) {
+	return i.manifest, nil
+}
+
+func (i *storeImage) MediaType() (types.MediaType, error) {
+	manifest, err := cranev1.ParseManifest(bytes.NewReader(i.manifest))
+	if err != nil {
+		return "", err
+	}
+	if manifest.MediaType == "" {
+		return types.OCIManifestSchema1, nil
+	}
+	return manifest.MediaType, nil
+}
+
+func (i *storeImage) LayerByDigest(h cranev1.Hash) (partial.CompressedLayer, error) {
+	layer, err := i.s.layerCache.Get(h)
+	if err == cache.ErrNotFound {
+		// The store skips downloading layers whose diffID it has unpacked
+		// already, for another image whose blob of the layer is compressed
+		// differently. Recompressing the unpacked layer would not give the
+		// blob the manifest refers to back, so get it from the registry.
+		klog.Infof("layer %s of image %s is not in the layer cache, fetching it from the registry", h, i.ref.Name())
+		return i.registryLayer(h)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading layer %s of image %s from the layer cache: %w", h, i.ref.Name(), err)
+	}
+	digest, err := layer.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("error getting digest of cached layer %s: %w", h, err)
+	}
+	if digest != h {
+		return nil, fmt.Errorf("cached layer %s of image %s has digest %s", h, i.ref.Name(), digest)
+	}
+	return layer, nil
+}
+
+// registryLayer returns the layer of the image with digest h, read from the
+// registry of the image.
+func (i *storeImage) registryLayer(h cranev1.Hash) (partial.CompressedLayer, error) {
+	manifest, err := cranev1.ParseManifest(bytes.NewReader(i.manifest))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing manifest of image %s: %w", i.ref.Name(), err)
+	}
+	for _, desc := range manifest.Layers {
+		if desc.Digest == h {
+			return &registryLayer{image: i, desc: desc}, nil
+		}
+	}
+	return nil, fmt.Errorf("image %s has no layer %s", i.ref.Name(), h)
+}
+
+// registryLayer is a layer of an exported image which is not in the layer
+// cache.
+type registryLayer struct {
+	image *storeImage
+	desc  cranev1.Descriptor
+}
+
+var _ partial.CompressedLayer = (*registryLayer)(nil)
+
+func (l *registryLayer) Digest() (cranev1.Hash, error) {
+	return l.desc.Digest, nil
+}
+
+func (l *registryLayer) Size() (int64, error) {
+	return l.desc.Size, nil
+}
+
+func (l *registryLayer) MediaType() (types.MediaType, error) {
+	return l.desc.MediaType, nil
+}
+
+// Compressed reads the layer from the first of the sources the registries
+// config gives for the image which has it. The blob is checked against its
+// digest as it is read.
+func (l *registryLayer) Compressed() (io.ReadCloser, error) {
+	s, ref := l.image.s, l.image.ref
+	sources, err := s.registries.sources(ref.Context().Digest(l.desc.Digest.String()))
+	if err != nil {
+		return nil, err
+	}
+	var errs []string
+	for _, source := range sources {
+		source, err := s.withTransportSettings(source)
+		if err != nil {
+			return nil, err
+		}
+		layer, err := remote.Layer(source.Context().Digest(l.desc.Digest.String()), s.remoteOptions(l.image.ctx)...)
+		if err == nil {
+			var rc io.ReadCloser
+			if rc, err = layer.Compressed(); err == nil {
+				return rc, nil
+			}
+		}
+		errs = append(errs, err.Error())
+	}
+	return nil, fmt.Errorf("layer %s of image %s is not in the layer cache and could not be fetched from the registry: %s",
+		l.desc.Digest, ref.Name(), strings.Join(errs, "; "))
+}
+
+// writeArchive writes the OCI layout at dir to a tarball at dest.
+func writeArchive(dir string, dest string) error {
+	f, err := ioutil.TempFile(filepath.Dir(dest), "kontained")
+	if err != nil {
+		return fmt.Errorf("failed to create tempfile for %q: %w", dest, err)
+	}
+	err = tarDir(dir, f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("error writing %q: %w", dest, err)
+	}
+	if err := os.Rename(f.Name(), dest); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to rename tempfile %q -> %q: %w", f.Name(), dest, err)
+	}
+	return nil
+}
+
+// tarDir writes the directories and regular files under dir to w.
+func tarDir(dir string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if !fi.IsDir() && !fi.Mode().IsRegular() {
+			return fmt.Errorf("unexpected file type for %q", p)
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		// The archive should not depend on who wrote it.
+		hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
@@ -0,0 +1,111 @@
+package images
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	cranev1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+func TestExportLayerUnpackedForAnotherImage(t *testing.T) {
+	srv := httptest.NewServer(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	// Two images with the same layer, compressed differently: the store
+	// only downloads the blob of the first one it extracts.
+	rc, err := newLayer(t, entry{name: "data", contents: strings.Repeat("layer ", 10000)}).Uncompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refs []name.Reference
+	var layers []cranev1.Layer
+	for i, level := range []int{gzip.BestSpeed, gzip.BestCompression} {
+		layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(b)), nil
+		}, tarball.WithCompressionLevel(level))
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := mutate.AppendLayers(empty.Image, layer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := name.ParseReference(host + "/export/image" + string(rune('a'+i)) + ":v1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := remote.Write(ref, img); err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, ref)
+		layers = append(layers, layer)
+	}
+	digest, err := layers[1].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other, err := layers[0].Digest(); err != nil || other == digest {
+		t.Fatalf("layers have the same digest %s", digest)
+	}
+
+	dir := t.TempDir()
+	s, err := NewStore(filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range refs {
+		if _, err := s.Extract(context.Background(), ref.String()); err != nil {
+			t.Fatalf("Extract: %v", err)
+		}
+	}
+	if _, err := s.layerCache.Get(digest); err == nil {
+		t.Fatalf("layer %s was downloaded, want it skipped", digest)
+	}
+
+	bundle := filepath.Join(dir, "bundle")
+	if _, err := s.Export(context.Background(), bundle, ExportLayout, []string{refs[1].String()}); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(bundle, "blobs", digest.Algorithm, digest.Hex)); err != nil {
+		t.Errorf("layer %s is not in the bundle: %v", digest, err)
+	}
+
+	imported, err := NewStore(filepath.Join(dir, "imported"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := imported.Import(context.Background(), bundle); err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	if _, err := imported.Extract(context.Background(), refs[1].String(), WithPullPolicy(PullNever)); err != nil {
+		t.Errorf("Extract of the imported image: %v", err)
+	}
+
+	// Without the registry, Export says where the layer should have come
+	// from.
+	srv.Close()
+	_, err = s.Export(context.Background(), filepath.Join(dir, "offline"), ExportLayout, []string{refs[1].String()})
+	if err == nil || !strings.Contains(err.Error(), "could not be fetched from the registry") {
+		t.Errorf("Export without the registry returned %v, want an error fetching the layer", err)
+	}
+}
@@ -3,6 +3,7 @@ package images
 import (
 	"archive/tar"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -11,14 +12,16 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
-	"github.com/google/go-containerregistry/pkg/crane"
+	securejoin "github.com/cyphar/filepath-securejoin"
 	cranev1 "github.com/google/go-containerregistry/pkg/v1"
+	"golang.org/x/sys/unix"
 
 	"k8s.io/klog/v2"
 )
 
-func (s *Store) extractImage(ctx context.Context, imageName string, img cranev1.Image, destDir string) error {
+func (s *Store) extractImage(ctx context.Context, imageName string, img cranev1.Image, destDir string, progress *progressReporter) error {
 	stat, err := os.Stat(destDir)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -30,17 +33,20 @@ func (s *Store) extractImage(ctx context.Context, imageName string, img cranev1.
 
 	if stat == nil {
 		klog.Infof("extracting image %s", imageName)
+		start := time.Now()
 
-		exportErr := make(chan error)
-		pr, pw := io.Pipe()
-		go func() {
-			defer pw.Close()
-			exportErr <- crane.Export(img, pw)
-		}()
+		layers, err := img.Layers()
+		if err != nil {
+			return fmt.Errorf("error getting layers of image: %w", err)
+		}
+
+		layerDirs, err := s.unpackLayers(ctx, layers, progress)
+		if err != nil {
+			return err
+		}
 
-		defer pr.Close()
+		progress.phase(PhaseCompose)
 
-		tr := tar.NewReader(pr)
 		if err := os.MkdirAll(filepath.Dir(destDir), 0755); err != nil {
 			return fmt.Errorf("failed to create directory %q: %w", filepath.Dir(destDir), err)
 		}
@@ -48,55 +54,97 @@ func (s *Store) extractImage(ctx context.Context, imageName string, img cranev1.
 		if err != nil {
 			return fmt.Errorf("failed to create tempdir for image: %w", err)
 		}
-
-		if err := untar(tr, tempDir); err != nil {
+		if err := os.Chmod(tempDir, 0755); err != nil {
 			os.RemoveAll(tempDir)
-			return fmt.Errorf("failed to extract image: %w", err)
+			return fmt.Errorf("failed to chmod %q: %w", tempDir, err)
 		}
 
-		if err := <-exportErr; err != nil {
+		files, err := applyLayers(layerDirs, tempDir)
+		if err != nil {
 			os.RemoveAll(tempDir)
-			return fmt.Errorf("error extracting image: %w", err)
+			return err
 		}
 
 		if err := os.Rename(tempDir, destDir); err != nil {
 			os.RemoveAll(tempDir)
+			// Another reference to the same image may have just been
+			// extracted.
+			if isDir(destDir) {
+				return nil
+			}
 			return fmt.Errorf("failed to rename extraction tempdir %q -> %q: %w", tempDir, destDir, err)
 		}
+		s.metrics.extracted(start, files)
 	}
 	return nil
 }
 
+// untarReport records the tar entries that untar was unable to recreate.
+type untarReport struct {
+	// SkippedDevices are the names of the char and block devices that were not
+	// created because we lack the privileges to do so.
+	SkippedDevices []string
+}
+
 // Based on https://pkg.go.dev/golang.org/x/build/internal/untar#Untar
-func untar(tr *tar.Reader, dir string) (err error) {
+//
+// Owners are mapped to the host through ids, which may be nil to keep the
+// owners from the tar as they are. onEntry, if not nil, is called for each
+// entry of the tar.
+func untar(tr *tar.Reader, dir string, ids *idMapper, onEntry func()) (*untarReport, error) {
 	dirAbs, err := filepath.Abs(dir)
 	if err != nil {
-		return fmt.Errorf("failed to get absolute path for %q: %w", dir, err)
+		return nil, fmt.Errorf("failed to get absolute path for %q: %w", dir, err)
 	}
 	dirAbs = filepath.Clean(dirAbs)
 	dirAbs = dirAbs + string(filepath.Separator)
 
+	report := &untarReport{}
+	privileged := os.Geteuid() == 0
+
 	madeDir := map[string]bool{}
 
+	// The mode and times of directories are only applied once everything has
+	// been extracted, as creating entries in a directory changes its mtime
+	// and a read-only directory would prevent us from creating them.
+	type extractedDir struct {
+		path   string
+		header *tar.Header
+	}
+	var dirs []extractedDir
+
 	for {
 		f, err := tr.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return fmt.Errorf("error reading tar entry: %w", err)
+			return nil, fmt.Errorf("error reading tar entry: %w", err)
+		}
+		if onEntry != nil {
+			onEntry()
 		}
 
 		if !validRelPath(f.Name) {
-			return fmt.Errorf("tar contained invalid name error %q", f.Name)
+			return nil, fmt.Errorf("tar contained invalid name error %q", f.Name)
+		}
+		rel := filepath.Clean(filepath.FromSlash(f.Name))
+		// An earlier entry may have made a parent of this one a symlink,
+		// which must not lead us outside of the target directory.
+		parent, err := securejoin.SecureJoin(dirAbs, filepath.Dir(rel))
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve directory of %q: %w", f.Name, err)
+		}
+		abs := filepath.Join(parent, filepath.Base(rel))
+		// Nor must we write through a symlink left at the path itself: the
+		// entry replaces what is there, unless both are directories.
+		if existing, err := os.Lstat(abs); err == nil && !existing.IsDir() {
+			if err := os.Remove(abs); err != nil {
+				return nil, fmt.Errorf("failed to remove %q: %w", abs, err)
+			}
 		}
-		rel := filepath.FromSlash(f.Name)
-		abs := filepath.Join(dir, rel)
 
-		fi := f.FileInfo()
-		mode := fi.Mode()
-		switch {
-		case mode.IsRegular():
+		if f.Typeflag != tar.TypeDir {
 			// Make the directory. This is redundant because it should
 			// already be made by a directory entry in the tar
 			// beforehand. Thus, don't check for errors; the next
@@ -104,50 +152,146 @@ func untar(tr *tar.Reader, dir string) (err error) {
 			dir := filepath.Dir(abs)
 			if !madeDir[dir] {
 				if err := os.MkdirAll(filepath.Dir(abs), 0755); err != nil {
-					return fmt.Errorf("failed to make directory %q: %w", abs, err)
+					return nil, fmt.Errorf("failed to make directory %q: %w", abs, err)
 				}
 				madeDir[dir] = true
 			}
+		}
+
+		fi := f.FileInfo()
+		mode := fi.Mode()
+		switch {
+		case f.Typeflag == tar.TypeLink:
+			// Hard link targets are relative to the root of the archive.
+			if !validRelPath(f.Linkname) {
+				return nil, fmt.Errorf("hard link %q -> %q has invalid target", f.Name, f.Linkname)
+			}
+			targetRel := filepath.FromSlash(f.Linkname)
+			targetAbs := filepath.Clean(filepath.Join(dir, targetRel))
+			if !strings.HasPrefix(targetAbs, dirAbs) {
+				return nil, fmt.Errorf("hard link %q -> %q (=> %q) was outside of target directory %q", f.Name, targetRel, targetAbs, dir)
+			}
+			// Unlike symlinks, hard links are resolved right now, so a
+			// symlink in one of the parent directories must not lead us
+			// outside of the target directory.
+			targetParent, err := securejoin.SecureJoin(dirAbs, filepath.Dir(targetRel))
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve hard link target %q: %w", f.Linkname, err)
+			}
+			targetAbs = filepath.Join(targetParent, filepath.Base(targetRel))
+
+			targetStat, err := os.Lstat(targetAbs)
+			if err != nil {
+				return nil, fmt.Errorf("hard link %q -> %q has no target: %w", f.Name, f.Linkname, err)
+			}
+			if targetStat.IsDir() {
+				return nil, fmt.Errorf("hard link %q -> %q points to a directory", f.Name, f.Linkname)
+			}
+
+			if err := os.RemoveAll(abs); err != nil {
+				return nil, fmt.Errorf("failed to remove %q: %w", abs, err)
+			}
+			if err := os.Link(targetAbs, abs); err != nil {
+				return nil, fmt.Errorf("failed to make hard link %q -> %q: %w", abs, targetAbs, err)
+			}
+
+		case mode.IsRegular():
 			wf, err := os.OpenFile(abs, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode.Perm())
 			if err != nil {
-				return err
+				return nil, err
 			}
 			n, err := io.Copy(wf, tr)
 			if closeErr := wf.Close(); closeErr != nil && err == nil {
 				err = closeErr
 			}
 			if err != nil {
-				return fmt.Errorf("error writing to %s: %w", abs, err)
+				return nil, fmt.Errorf("error writing to %s: %w", abs, err)
 			}
 			if n != f.Size {
-				return fmt.Errorf("only wrote %d bytes to %s; expected %d", n, abs, f.Size)
+				return nil, fmt.Errorf("only wrote %d bytes to %s; expected %d", n, abs, f.Size)
 			}
 
 		case mode.IsDir():
 			if err := os.MkdirAll(abs, 0755); err != nil {
-				return fmt.Errorf("failed to make directory %q: %w", abs, err)
+				return nil, fmt.Errorf("failed to make directory %q: %w", abs, err)
 			}
 			madeDir[abs] = true
+			dirs = append(dirs, extractedDir{path: abs, header: f})
 
-		default:
-			if mode.Type() == fs.ModeSymlink {
-				targetRel := filepath.FromSlash(f.Linkname)
-				// This is relatively safe because we will chroot
+		case mode.Type() == fs.ModeSymlink:
+			targetRel := filepath.FromSlash(f.Linkname)
+			// This is relatively safe because we will chroot
 
-				targetAbs := filepath.Clean(filepath.Join(dir, filepath.Dir(f.Name), targetRel))
-				if !strings.HasPrefix(targetAbs, dirAbs) {
-					return fmt.Errorf("symlink %q -> %q (=> %q) was outside of target directory %q", f.Name, targetRel, targetAbs, dir)
-				}
+			targetAbs := filepath.Clean(filepath.Join(dir, filepath.Dir(f.Name), targetRel))
+			if !strings.HasPrefix(targetAbs, dirAbs) {
+				return nil, fmt.Errorf("symlink %q -> %q (=> %q) was outside of target directory %q", f.Name, targetRel, targetAbs, dir)
+			}
+
+			if err := os.Symlink(targetRel, abs); err != nil {
+				return nil, fmt.Errorf("failed to make symlink %q -> %q: %w", abs, targetRel, err)
+			}
+
+		case mode.Type() == fs.ModeNamedPipe:
+			if err := unix.Mkfifo(abs, uint32(mode.Perm())); err != nil {
+				return nil, fmt.Errorf("failed to make fifo %q: %w", abs, err)
+			}
 
-				if err := os.Symlink(targetRel, abs); err != nil {
-					return fmt.Errorf("failed to make symlink %q -> %q: %w", abs, targetRel, err)
+		case mode.Type() == fs.ModeDevice, mode.Type() == fs.ModeDevice|fs.ModeCharDevice:
+			if !privileged {
+				report.SkippedDevices = append(report.SkippedDevices, f.Name)
+				continue
+			}
+			devType := uint32(unix.S_IFBLK)
+			if f.Typeflag == tar.TypeChar {
+				devType = unix.S_IFCHR
+			}
+			dev := unix.Mkdev(uint32(f.Devmajor), uint32(f.Devminor))
+			if err := unix.Mknod(abs, devType|uint32(mode.Perm()), int(dev)); err != nil {
+				// Being root in a user namespace is not enough to create
+				// devices.
+				if errors.Is(err, unix.EPERM) {
+					report.SkippedDevices = append(report.SkippedDevices, f.Name)
+					continue
 				}
-			} else {
-				klog.Warningf("skipping tar file entry %s with unsupported file type %v", f.Name, mode)
+				return nil, fmt.Errorf("failed to make device %q: %w", abs, err)
 			}
+
+		default:
+			klog.Warningf("skipping tar file entry %s with unsupported file type %v", f.Name, mode)
+			continue
+		}
+
+		if f.Typeflag == tar.TypeLink {
+			// The target already carries the metadata.
+			continue
+		}
+		if err := applyOwnership(abs, f, ids); err != nil {
+			return nil, err
+		}
+		if err := applyXattrs(abs, f); err != nil {
+			return nil, err
+		}
+		if mode.IsDir() {
+			continue
+		}
+		if err := applyMode(abs, mode); err != nil {
+			return nil, err
+		}
+		if err := applyTimes(abs, f.AccessTime, f.ModTime); err != nil {
+			return nil, err
 		}
 	}
-	return nil
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d := dirs[i]
+		if err := applyMode(d.path, d.header.FileInfo().Mode()); err != nil {
+			return nil, err
+		}
+		if err := applyTimes(d.path, d.header.AccessTime, d.header.ModTime); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
 }
 
 func validRelativeDir(dir string) bool {
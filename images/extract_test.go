@@ -0,0 +1,117 @@
+package images
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUntarStaysInRoot(t *testing.T) {
+	tests := []struct {
+		name string
+		// headers make the layer, given the host directory it tries to
+		// write to. Regular files contain "evil".
+		headers func(host string) []*tar.Header
+	}{
+		{
+			name: "hard link through a symlinked directory",
+			headers: func(host string) []*tar.Header {
+				return []*tar.Header{
+					{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: host},
+					{Name: "a", Typeflag: tar.TypeReg, Mode: 0644},
+					{Name: "etc/passwd", Typeflag: tar.TypeLink, Linkname: "a"},
+				}
+			},
+		},
+		{
+			name: "file through a symlinked directory",
+			headers: func(host string) []*tar.Header {
+				return []*tar.Header{
+					{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: host},
+					{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+				}
+			},
+		},
+		{
+			name: "directory through a symlinked directory",
+			headers: func(host string) []*tar.Header {
+				return []*tar.Header{
+					{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: host},
+					{Name: "etc/new/", Typeflag: tar.TypeDir, Mode: 0755},
+				}
+			},
+		},
+		{
+			name: "fifo through a symlinked directory",
+			headers: func(host string) []*tar.Header {
+				return []*tar.Header{
+					{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: host},
+					{Name: "etc/fifo", Typeflag: tar.TypeFifo, Mode: 0644},
+				}
+			},
+		},
+		{
+			name: "file over a symlink",
+			headers: func(host string) []*tar.Header {
+				return []*tar.Header{
+					{Name: "passwd", Typeflag: tar.TypeSymlink, Linkname: filepath.Join(host, "passwd")},
+					{Name: "passwd", Typeflag: tar.TypeReg, Mode: 0644},
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			host := filepath.Join(dir, "host")
+			if err := os.Mkdir(host, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(host, "passwd"), []byte("root"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			for _, hdr := range tt.headers(host) {
+				if hdr.Typeflag == tar.TypeReg {
+					hdr.Size = int64(len("evil"))
+				}
+				if err := tw.WriteHeader(hdr); err != nil {
+					t.Fatal(err)
+				}
+				if hdr.Typeflag == tar.TypeReg {
+					if _, err := tw.Write([]byte("evil")); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			root := filepath.Join(dir, "root")
+			// The symlinks are resolved within the root, where the
+			// entries go instead.
+			if _, err := untar(tar.NewReader(&buf), root, nil, nil); err != nil {
+				t.Fatalf("untar: %v", err)
+			}
+
+			entries, err := ioutil.ReadDir(host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Errorf("got %d entries in the host directory, want only passwd", len(entries))
+			}
+			b, err := ioutil.ReadFile(filepath.Join(host, "passwd"))
+			if err != nil || string(b) != "root" {
+				t.Errorf("host passwd has %q (%v), want it untouched", b, err)
+			}
+		})
+	}
+}
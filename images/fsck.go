@@ -0,0 +1,217 @@
+package images
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"k8s.io/klog/v2"
+)
+
+// FsckProblem is an inconsistency found in the store.
+type FsckProblem struct {
+	Path        string
+	Description string
+	// Repaired is true if the problem was fixed.
+	Repaired bool
+}
+
+// FsckReport lists the inconsistencies found by Fsck.
+type FsckReport struct {
+	Problems []FsckProblem
+}
+
+// Fsck checks the store for the leftovers of interrupted operations:
+// temporary directories and files, metadata files which cannot be read or
+// whose extracted directory is missing, and extracted directories without
+// metadata. With repair set, metadata of older versions and stores is
+// migrated and the offending paths are removed; the images concerned will be
+// pulled again on the next Extract. Metadata which cannot be migrated is
+// reported, but kept along with its image.
+func (s *Store) Fsck(ctx context.Context, repair bool) (*FsckReport, error) {
+	lock, err := s.lockStore(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	return s.fsck(repair)
+}
+
+// recover repairs the store when it is created, unless another process is
+// using the store: then what looks like leftovers may well be in progress.
+func (s *Store) recover() error {
+	if _, err := os.Stat(s.baseDir); os.IsNotExist(err) {
+		return nil
+	}
+	lock, err := tryLockFile(s.storeLockPath(), true)
+	if err != nil {
+		return err
+	}
+	if lock == nil {
+		klog.V(2).Infof("store %s is in use, skipping recovery", s.baseDir)
+		return nil
+	}
+	defer lock.Unlock()
+
+	report, err := s.fsck(true)
+	if err != nil {
+		return err
+	}
+	for _, problem := range report.Problems {
+		if !problem.Repaired {
+			klog.Warningf("store: %s: %s", problem.Path, problem.Description)
+			continue
+		}
+		klog.Warningf("recovered store: %s: %s", problem.Path, problem.Description)
+	}
+	return nil
+}
+
+func (s *Store) fsck(repair bool) (*FsckReport, error) {
+	report := &FsckReport{}
+	problem := func(p string, format string, args ...interface{}) error {
+		fsckProblem := FsckProblem{
+			Path:        p,
+			Description: fmt.Sprintf(format, args...),
+		}
+		if repair {
+			if err := removeAll(p); err != nil {
+				return err
+			}
+			fsckProblem.Repaired = true
+		}
+		report.Problems = append(report.Problems, fsckProblem)
+		return nil
+	}
+
+	if repair {
+		if err := s.migrateLayout(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Temporary directories and files are only used while holding the
+	// store lock (shared), so with the lock held exclusively they are
+	// leftovers.
+	tempDirs := []string{s.baseDir, s.indexDir()}
+	for _, dir := range []string{s.rootfsDir(), s.layers.dir, s.blobsDir(), s.poolObjectsDir(), s.poolRefsDir()} {
+		algorithms, err := ioutil.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read directory %q: %w", dir, err)
+		}
+		for _, algorithm := range algorithms {
+			tempDirs = append(tempDirs, filepath.Join(dir, algorithm.Name()))
+		}
+	}
+	for _, dir := range tempDirs {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read directory %q: %w", dir, err)
+		}
+		for _, entry := range entries {
+			if !isTempDir(entry.Name()) {
+				continue
+			}
+			if err := problem(filepath.Join(dir, entry.Name()), "stale temporary file"); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	entries, err := ioutil.ReadDir(s.indexDir())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read directory %q: %w", s.indexDir(), err)
+	}
+
+	extracted := map[string]bool{}
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || isTempDir(entry.Name()) {
+			continue
+		}
+		p := filepath.Join(s.indexDir(), entry.Name())
+		info, err := readMetadata(p)
+		if err != nil {
+			if err := problem(p, "unreadable metadata: %v", err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// Metadata of a version we know nothing about may be from a newer
+		// version of the store, so it is left alone. Metadata which fails to
+		// migrate is left too, with its image, for Extract to pull it again.
+		if repair && info.Version != cachedImageFormatVersion && findMigration(info.Version) != nil {
+			if err := s.migrateMetadata(p, info); err != nil {
+				report.Problems = append(report.Problems, FsckProblem{
+					Path:        p,
+					Description: fmt.Sprintf("outdated metadata: %v", err),
+				})
+			}
+		}
+		extractedDir := s.extractedPath(info)
+		if !isDir(extractedDir) {
+			if err := problem(p, "metadata for %s refers to missing directory %q", info.Name, extractedDir); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		extracted["sha256:"+info.Digest] = true
+	}
+
+	algorithms, err := ioutil.ReadDir(s.rootfsDir())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read directory %q: %w", s.rootfsDir(), err)
+	}
+	for _, algorithm := range algorithms {
+		algorithmDir := filepath.Join(s.rootfsDir(), algorithm.Name())
+		entries, err := ioutil.ReadDir(algorithmDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read directory %q: %w", algorithmDir, err)
+		}
+		for _, entry := range entries {
+			if isTempDir(entry.Name()) || extracted[algorithm.Name()+":"+entry.Name()] {
+				continue
+			}
+			if err := problem(filepath.Join(algorithmDir, entry.Name()), "extracted directory without metadata"); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// What is left in baseDir of the layout older stores used could not be
+	// migrated when repairing, or is reported as it is otherwise.
+	entries, err = ioutil.ReadDir(s.baseDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read directory %q: %w", s.baseDir, err)
+	}
+	legacy := map[string]bool{}
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || isTempDir(entry.Name()) || reservedNames[entry.Name()] {
+			continue
+		}
+		p := filepath.Join(s.baseDir, entry.Name())
+		info, err := readMetadata(p)
+		if err != nil {
+			if err := problem(p, "unreadable metadata: %v", err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := problem(p, "metadata for %s outside of the index", info.Name); err != nil {
+			return nil, err
+		}
+		legacy[legacyExtractedName(info)] = true
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || reservedNames[entry.Name()] || isTempDir(entry.Name()) || legacy[entry.Name()] {
+			continue
+		}
+		if err := problem(filepath.Join(s.baseDir, entry.Name()), "extracted directory without metadata"); err != nil {
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
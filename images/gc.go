@@ -0,0 +1,473 @@
+package images
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	cranev1 "github.com/google/go-containerregistry/pkg/v1"
+
+	"k8s.io/klog/v2"
+)
+
+// GCPolicy bounds how much the store keeps around, on top of the removal of
+// unreferenced data which GC always does.
+type GCPolicy struct {
+	// MaxBytes is the disk space the store may use. The least recently used
+	// images are removed until the store fits. Zero means no limit.
+	MaxBytes int64
+	// MaxAge removes images which have not been used for longer than this.
+	// Zero means no limit.
+	MaxAge time.Duration
+}
+
+// GCResult reports what GC removed.
+type GCResult struct {
+	// RemovedImages are the names of the images evicted by the policy.
+	RemovedImages []string
+	// RemovedPaths are all the files and directories removed from the store.
+	RemovedPaths []string
+	// ReclaimedBytes is the disk space freed.
+	ReclaimedBytes int64
+}
+
+// storedImage is a metadata file in the store.
+type storedImage struct {
+	path string
+	info *cachedImage
+}
+
+// lastUsed returns when the image was last used. Metadata written before
+// usage was tracked falls back to the mtime of the metadata file.
+func (i *storedImage) lastUsed() time.Time {
+	if !i.info.LastUsed.IsZero() {
+		return i.info.LastUsed
+	}
+	stat, err := os.Stat(i.path)
+	if err != nil {
+		return time.Time{}
+	}
+	return stat.ModTime()
+}
+
+// reservedNames are the entries of baseDir which are not images.
+var reservedNames = map[string]bool{
+	"blobs":        true,
+	"cache":        true,
+	"index":        true,
+	"layers":       true,
+	"locks":        true,
+	"pool":         true,
+	"rootfs":       true,
+	idMappingsName: true,
+}
+
+// isTempDir returns true for the temporary directories of extractions, and
+// the temporary files of atomic writes.
+func isTempDir(name string) bool {
+	return strings.HasPrefix(name, "kontained")
+}
+
+// listImages returns all the metadata files in the store. Files which cannot
+// be parsed are skipped.
+func (s *Store) listImages() ([]*storedImage, error) {
+	entries, err := ioutil.ReadDir(s.indexDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read directory %q: %w", s.indexDir(), err)
+	}
+
+	var images []*storedImage
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || isTempDir(entry.Name()) {
+			continue
+		}
+		p := filepath.Join(s.indexDir(), entry.Name())
+		info, err := readMetadata(p)
+		if err != nil {
+			klog.V(2).Infof("ignoring unreadable metadata file %q: %v", p, err)
+			continue
+		}
+		images = append(images, &storedImage{path: p, info: info})
+	}
+	return images, nil
+}
+
+// GC removes extracted images, unpacked layers, cached layers and pooled
+// files that are no longer referenced by any image metadata, after evicting
+// the images that are outside of the policy.
+func (s *Store) GC(ctx context.Context, policy GCPolicy) (*GCResult, error) {
+	lock, err := s.lockStore(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	result := &GCResult{}
+
+	// Files are hard-linked between the layers and the extracted images, so
+	// only comparing the usage of the whole store tells what was reclaimed.
+	before, err := diskUsage(s.baseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := s.listImages()
+	if err != nil {
+		return nil, err
+	}
+
+	// Least recently used first.
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].lastUsed().Before(images[j].lastUsed())
+	})
+
+	if policy.MaxAge != 0 {
+		cutoff := time.Now().Add(-policy.MaxAge)
+		for len(images) != 0 && images[0].lastUsed().Before(cutoff) {
+			if err := s.evict(images[0], result); err != nil {
+				return nil, err
+			}
+			images = images[1:]
+		}
+	}
+
+	if err := s.removeUnreferenced(images, result); err != nil {
+		return nil, err
+	}
+
+	if policy.MaxBytes != 0 {
+		for len(images) != 0 {
+			used, err := diskUsage(s.baseDir)
+			if err != nil {
+				return nil, err
+			}
+			if used <= policy.MaxBytes {
+				break
+			}
+			klog.V(2).Infof("store uses %d bytes, more than the allowed %d", used, policy.MaxBytes)
+			if err := s.evict(images[0], result); err != nil {
+				return nil, err
+			}
+			images = images[1:]
+			if err := s.removeUnreferenced(images, result); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	after, err := diskUsage(s.baseDir)
+	if err != nil {
+		return nil, err
+	}
+	result.ReclaimedBytes = before - after
+	s.metrics.reclaimed(result.ReclaimedBytes)
+	return result, nil
+}
+
+// evict removes the metadata of an image. Its extracted directory goes with
+// the next removeUnreferenced, unless another reference to the image uses it.
+func (s *Store) evict(image *storedImage, result *GCResult) error {
+	klog.Infof("evicting image %s, last used %v", image.info.Name, image.lastUsed())
+	if err := s.removePath(image.path, result); err != nil {
+		return err
+	}
+	result.RemovedImages = append(result.RemovedImages, image.info.Name)
+	return nil
+}
+
+// references are what a set of images uses in the store.
+type references struct {
+	extracted map[string]bool
+	layers    map[string]bool
+	blobs     map[string]bool
+	// cached holds both digests and diffIDs: layers are cached compressed,
+	// but stores written before that cached them uncompressed.
+	cached map[string]bool
+	// locks are the names of the lock files of the images and layers.
+	locks map[string]bool
+}
+
+func imageReferences(images []*storedImage) *references {
+	refs := &references{
+		extracted: map[string]bool{},
+		layers:    map[string]bool{},
+		blobs:     map[string]bool{},
+		cached:    map[string]bool{},
+		locks:     map[string]bool{},
+	}
+	for _, image := range images {
+		refs.extracted["sha256:"+image.info.Digest] = true
+		for _, layer := range image.info.Layers {
+			refs.layers[layer] = true
+			refs.cached[layer] = true
+			refs.locks[layerLockName(layer)] = true
+		}
+		for _, layer := range image.info.LayerDigests {
+			refs.cached[layer] = true
+		}
+		refs.blobs["sha256:"+image.info.Digest] = true
+		if image.info.ConfigDigest != "" {
+			refs.blobs[image.info.ConfigDigest] = true
+		}
+		refs.locks[imageLockName(image.info.Name)] = true
+	}
+	return refs
+}
+
+// removeUnreferenced removes everything in the store not needed by images.
+func (s *Store) removeUnreferenced(images []*storedImage, result *GCResult) error {
+	refs := imageReferences(images)
+
+	if err := s.removeUnreferencedHashes(s.rootfsDir(), refs.extracted, result); err != nil {
+		return err
+	}
+	// Images used to be extracted right into baseDir.
+	entries, err := ioutil.ReadDir(s.baseDir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read directory %q: %w", s.baseDir, err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || reservedNames[entry.Name()] || isTempDir(entry.Name()) {
+			continue
+		}
+		if err := s.removePath(filepath.Join(s.baseDir, entry.Name()), result); err != nil {
+			return err
+		}
+	}
+
+	if err := s.removeUnreferencedHashes(s.layers.dir, refs.layers, result); err != nil {
+		return err
+	}
+	if err := s.removeUnreferencedHashes(s.blobsDir(), refs.blobs, result); err != nil {
+		return err
+	}
+
+	// Objects of the pool are referenced by the layers which use them, and
+	// the layers removed above no longer do.
+	objects, err := s.poolObjects(refs.layers)
+	if err != nil {
+		return err
+	}
+	if err := s.removeUnreferencedHashes(s.poolRefsDir(), refs.layers, result); err != nil {
+		return err
+	}
+	if err := s.removeUnreferencedHashes(s.poolObjectsDir(), objects, result); err != nil {
+		return err
+	}
+
+	cacheDir := filepath.Join(s.baseDir, "cache")
+	entries, err = ioutil.ReadDir(cacheDir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read directory %q: %w", cacheDir, err)
+	}
+	for _, layer := range entries {
+		if refs.cached[layer.Name()] {
+			continue
+		}
+		if err := s.removePath(filepath.Join(cacheDir, layer.Name()), result); err != nil {
+			return err
+		}
+	}
+
+	// The locks of images and layers which are gone. Unknown files are left
+	// alone, and so is the store lock, which the caller holds.
+	entries, err = ioutil.ReadDir(s.locksDir())
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read directory %q: %w", s.locksDir(), err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if (!strings.HasPrefix(name, "image-") && !strings.HasPrefix(name, "layer-")) || refs.locks[name] {
+			continue
+		}
+		if err := s.removePath(filepath.Join(s.locksDir(), name), result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeImageData removes what the removed images used in the store and the
+// remaining images do not: their extracted directories, unpacked layers and
+// the pool objects only those layers use, cached layers, manifests, configs
+// and locks. Unlike removeUnreferenced, it leaves the rest of the store alone.
+func (s *Store) removeImageData(removed, remaining []*storedImage, result *GCResult) error {
+	gone, refs := imageReferences(removed), imageReferences(remaining)
+	layers := unreferenced(gone.layers, refs.layers)
+
+	if err := s.removeHashes(s.rootfsDir(), unreferenced(gone.extracted, refs.extracted), result); err != nil {
+		return err
+	}
+
+	// Read which objects the layers use before their refs go with them.
+	objects, err := s.poolObjects(layers)
+	if err != nil {
+		return err
+	}
+	used, err := s.poolObjects(refs.layers)
+	if err != nil {
+		return err
+	}
+	if err := s.removeHashes(s.layers.dir, layers, result); err != nil {
+		return err
+	}
+	if err := s.removeHashes(s.poolRefsDir(), layers, result); err != nil {
+		return err
+	}
+	if err := s.removeHashes(s.poolObjectsDir(), unreferenced(objects, used), result); err != nil {
+		return err
+	}
+
+	if err := s.removeHashes(s.blobsDir(), unreferenced(gone.blobs, refs.blobs), result); err != nil {
+		return err
+	}
+	// The layer cache names blobs by their digest.
+	for _, name := range sortedNames(unreferenced(gone.cached, refs.cached)) {
+		if err := s.removePath(filepath.Join(s.baseDir, "cache", name), result); err != nil {
+			return err
+		}
+	}
+	for _, name := range sortedNames(unreferenced(gone.locks, refs.locks)) {
+		if err := s.removePath(filepath.Join(s.locksDir(), name), result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unreferenced returns the entries of used which are not in referenced.
+func unreferenced(used, referenced map[string]bool) map[string]bool {
+	entries := map[string]bool{}
+	for entry := range used {
+		if !referenced[entry] {
+			entries[entry] = true
+		}
+	}
+	return entries
+}
+
+func sortedNames(m map[string]bool) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// removeHashes removes the given entries of a directory laid out as
+// <algorithm>/<hex>.
+func (s *Store) removeHashes(dir string, hashes map[string]bool, result *GCResult) error {
+	for _, entry := range sortedNames(hashes) {
+		h, err := cranev1.NewHash(entry)
+		if err != nil {
+			return fmt.Errorf("invalid digest %q: %w", entry, err)
+		}
+		if err := s.removePath(filepath.Join(dir, h.Algorithm, h.Hex), result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeUnreferencedHashes removes the entries of a directory laid out as
+// <algorithm>/<hex> whose hash is not in referenced.
+func (s *Store) removeUnreferencedHashes(dir string, referenced map[string]bool, result *GCResult) error {
+	algorithms, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read directory %q: %w", dir, err)
+	}
+	for _, algorithm := range algorithms {
+		algorithmDir := filepath.Join(dir, algorithm.Name())
+		entries, err := ioutil.ReadDir(algorithmDir)
+		if err != nil {
+			return fmt.Errorf("failed to read directory %q: %w", algorithmDir, err)
+		}
+		for _, entry := range entries {
+			h := cranev1.Hash{Algorithm: algorithm.Name(), Hex: entry.Name()}
+			if isTempDir(entry.Name()) || referenced[h.String()] {
+				continue
+			}
+			if err := s.removePath(filepath.Join(algorithmDir, entry.Name()), result); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removePath removes p, recording it in result.
+func (s *Store) removePath(p string, result *GCResult) error {
+	if _, err := os.Lstat(p); os.IsNotExist(err) {
+		return nil
+	}
+	if err := removeAll(p); err != nil {
+		return err
+	}
+	klog.V(2).Infof("removed %q", p)
+	result.RemovedPaths = append(result.RemovedPaths, p)
+	return nil
+}
+
+// removeAll is os.RemoveAll, but also removes the contents of read-only
+// directories, which extracted images may well contain.
+func removeAll(p string) error {
+	if err := os.RemoveAll(p); err == nil {
+		return nil
+	}
+	filepath.Walk(p, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && fi.IsDir() {
+			os.Chmod(p, 0700)
+		}
+		return nil
+	})
+	if err := os.RemoveAll(p); err != nil {
+		return fmt.Errorf("failed to remove %q: %w", p, err)
+	}
+	return nil
+}
+
+// diskUsage returns the disk space used by everything under p, counting
+// hard-linked files once.
+func diskUsage(p string) (int64, error) {
+	type inode struct {
+		dev uint64
+		ino uint64
+	}
+	seen := map[inode]bool{}
+
+	var total int64
+	err := filepath.Walk(p, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			total += fi.Size()
+			return nil
+		}
+		key := inode{dev: uint64(st.Dev), ino: st.Ino}
+		if seen[key] {
+			return nil
+		}
+		seen[key] = true
+		total += st.Blocks * 512
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to compute disk usage of %q: %w", p, err)
+	}
+	return total, nil
+}
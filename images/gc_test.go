@@ -0,0 +1,151 @@
+package images
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	cranev1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func exists(p string) bool {
+	_, err := os.Lstat(p)
+	return err == nil
+}
+
+func TestRemoveAndGC(t *testing.T) {
+	srv := httptest.NewServer(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	// Two images sharing their first layer.
+	shared, err := random.Layer(1000, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refs []name.Reference
+	var own []cranev1.Hash
+	for _, repo := range []string{"removed", "kept"} {
+		layer, err := random.Layer(1000, types.DockerLayer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := mutate.AppendLayers(empty.Image, shared, layer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := name.ParseReference(host + "/gc/" + repo + ":v1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := remote.Write(ref, img); err != nil {
+			t.Fatal(err)
+		}
+		diffID, err := layer.DiffID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, ref)
+		own = append(own, diffID)
+	}
+	sharedDiffID, err := shared.DiffID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var extracted []*Extracted
+	for _, ref := range refs {
+		e, err := s.Extract(context.Background(), ref.String())
+		if err != nil {
+			t.Fatalf("Extract: %v", err)
+		}
+		extracted = append(extracted, e)
+	}
+
+	// Leftovers which Remove leaves for GC.
+	orphanDir := s.digestPath(strings.Repeat("0", 64))
+	staleLock := filepath.Join(s.locksDir(), imageLockName("example.com/gone:v1"))
+	for _, p := range []string{orphanDir, staleLock} {
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(orphanDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(staleLock, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lockPath := func(name string) string { return filepath.Join(s.locksDir(), name) }
+	removedLayer := s.layers.path(own[0])
+	keptLayer := s.layers.path(own[1])
+	sharedLayer := s.layers.path(sharedDiffID)
+
+	if _, err := s.Remove(context.Background(), refs[0].String()); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	for _, p := range []string{
+		extracted[0].ExtractedDir,
+		removedLayer,
+		lockPath(imageLockName(refs[0].Name())),
+		lockPath(layerLockName(own[0].String())),
+	} {
+		if exists(p) {
+			t.Errorf("Remove left %q", p)
+		}
+	}
+	for _, p := range []string{
+		extracted[1].ExtractedDir,
+		keptLayer,
+		sharedLayer,
+		lockPath(imageLockName(refs[1].Name())),
+		lockPath(layerLockName(sharedDiffID.String())),
+		s.storeLockPath(),
+		orphanDir,
+		staleLock,
+	} {
+		if !exists(p) {
+			t.Errorf("Remove removed %q", p)
+		}
+	}
+
+	if _, err := s.GC(context.Background(), GCPolicy{}); err != nil {
+		t.Fatalf("GC: %v", err)
+	}
+	for _, p := range []string{orphanDir, staleLock} {
+		if exists(p) {
+			t.Errorf("GC left %q", p)
+		}
+	}
+	for _, p := range []string{
+		extracted[1].ExtractedDir,
+		lockPath(imageLockName(refs[1].Name())),
+		lockPath(layerLockName(own[1].String())),
+		lockPath(layerLockName(sharedDiffID.String())),
+		s.storeLockPath(),
+	} {
+		if !exists(p) {
+			t.Errorf("GC removed %q", p)
+		}
+	}
+	if _, err := s.Extract(context.Background(), refs[1].String(), WithPullPolicy(PullNever)); err != nil {
+		t.Errorf("Extract of the remaining image: %v", err)
+	}
+}
@@ -0,0 +1,338 @@
+package images
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	cranev1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// annotationRefName is the OCI annotation naming an image in a layout.
+	annotationRefName = "org.opencontainers.image.ref.name"
+	// annotationContainerdName is the full image name containerd (and
+	// nerdctl save) record in a layout, where ref.name is only the tag.
+	annotationContainerdName = "io.containerd.image.name"
+
+	// ociLayoutFile marks the root of an OCI image layout.
+	ociLayoutFile = "oci-layout"
+)
+
+// importedImage is an image found in an OCI layout or tarball.
+type importedImage struct {
+	ref name.Reference
+	img cranev1.Image
+	// digest is the digest of the manifest the reference points to, which
+	// for a multi-platform image is the index rather than img.
+	digest cranev1.Hash
+	// platform is the platform img is recorded for.
+	platform cranev1.Platform
+}
+
+// Import loads the images in an OCI image layout directory, a tarball of
+// one (as written by Export), or a tarball written by `docker save`, and
+// records them under the references they were saved with. Extract then uses
+// them without contacting the registry. Bundles written by Export are checked
+// to hold all the images they list before anything is imported.
+// It returns the names of the imported images.
+func (s *Store) Import(ctx context.Context, path string) ([]string, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error doing stat(%q): %w", path, err)
+	}
+
+	var images []importedImage
+	if stat.IsDir() {
+		images, err = readLayout(path)
+	} else if isLayoutArchive(path) {
+		var dir string
+		dir, err = ioutil.TempDir("", "kontained")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create tempdir for %q: %w", path, err)
+		}
+		defer os.RemoveAll(dir)
+		if err := unpackArchive(path, dir); err != nil {
+			return nil, err
+		}
+		images, err = readLayout(dir)
+	} else {
+		images, err = readTarball(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("no named images found in %q", path)
+	}
+
+	var imported []string
+	for _, image := range images {
+		if err := s.importImage(ctx, image); err != nil {
+			return imported, err
+		}
+		imported = append(imported, image.ref.Name())
+	}
+	return imported, nil
+}
+
+func (s *Store) importImage(ctx context.Context, image importedImage) error {
+	storeLock, err := s.lockStore(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer storeLock.Unlock()
+
+	imageLock, err := s.lockImage(ctx, image.ref.Name())
+	if err != nil {
+		return err
+	}
+	defer imageLock.Unlock()
+
+	klog.Infof("importing image %s", image.ref.Name())
+	img := cache.Image(image.img, s.layerCache)
+	_, err = s.extractAndRecord(ctx, image.ref, image.ref.Name(), img, image.platform, provenance{remoteDigest: image.digest, imported: true}, nil)
+	return err
+}
+
+// readLayout returns the named images of an OCI image layout.
+func readLayout(path string) ([]importedImage, error) {
+	idx, err := layout.ImageIndexFromPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading OCI layout %q: %w", path, err)
+	}
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("error reading index of OCI layout %q: %w", path, err)
+	}
+
+	var images []importedImage
+	for _, desc := range manifest.Manifests {
+		refName := desc.Annotations[annotationContainerdName]
+		if refName == "" {
+			refName = desc.Annotations[annotationRefName]
+		}
+		if refName == "" {
+			klog.Warningf("skipping unnamed image %s in OCI layout %q", desc.Digest, path)
+			continue
+		}
+		ref, err := name.ParseReference(refName, name.StrictValidation)
+		if err != nil {
+			return nil, fmt.Errorf("image %s in OCI layout %q has invalid name %q: %w", desc.Digest, path, refName, err)
+		}
+
+		var img cranev1.Image
+		platform := hostPlatform()
+		if desc.MediaType.IsIndex() {
+			child, err := idx.ImageIndex(desc.Digest)
+			if err != nil {
+				return nil, fmt.Errorf("error reading index %s of OCI layout %q: %w", desc.Digest, path, err)
+			}
+			img, err = imageForPlatform(child, platform)
+			if err != nil {
+				return nil, fmt.Errorf("image %s in OCI layout %q: %w", refName, path, err)
+			}
+		} else {
+			img, err = idx.Image(desc.Digest)
+			if err != nil {
+				return nil, fmt.Errorf("error reading image %s of OCI layout %q: %w", desc.Digest, path, err)
+			}
+			if desc.Platform != nil {
+				platform = normalizePlatform(*desc.Platform)
+			}
+			platform, err = configPlatform(img, platform)
+			if err != nil {
+				return nil, fmt.Errorf("image %s in OCI layout %q: %w", refName, path, err)
+			}
+		}
+		images = append(images, importedImage{ref: ref, img: img, digest: desc.Digest, platform: platform})
+	}
+
+	if err := verifyBundle(path, images); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// verifyBundle checks that the OCI layout at path has all the images listed
+// in its bundle manifest, with all their blobs. Layouts without a bundle
+// manifest were not written by Export and are not checked.
+func verifyBundle(path string, images []importedImage) error {
+	b, err := ioutil.ReadFile(filepath.Join(path, bundleManifestName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading bundle manifest: %w", err)
+	}
+	bundle := &bundleManifest{}
+	if err := json.Unmarshal(b, bundle); err != nil {
+		return fmt.Errorf("error parsing bundle manifest: %w", err)
+	}
+
+	// A bundle may hold the same name for several platforms, so the images
+	// are told apart by their digest too.
+	found := map[string]importedImage{}
+	for _, image := range images {
+		found[image.ref.Name()+"@"+image.digest.String()] = image
+	}
+	for _, want := range bundle.Images {
+		image, ok := found[want.Name+"@"+want.Digest]
+		if !ok {
+			return fmt.Errorf("bundle is incomplete: image %s@%s is missing", want.Name, want.Digest)
+		}
+
+		manifest, err := image.img.Manifest()
+		if err != nil {
+			return fmt.Errorf("error reading manifest of image %s: %w", want.Name, err)
+		}
+		blobs := []cranev1.Hash{manifest.Config.Digest}
+		for _, layer := range manifest.Layers {
+			blobs = append(blobs, layer.Digest)
+		}
+		for _, h := range blobs {
+			p := filepath.Join(path, "blobs", h.Algorithm, h.Hex)
+			if _, err := os.Stat(p); err != nil {
+				return fmt.Errorf("bundle is incomplete: blob %s of image %s is missing: %w", h, want.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// isLayoutArchive returns whether the file at path is a tarball of an OCI
+// image layout, rather than one written by `docker save`.
+func isLayoutArchive(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			return false
+		}
+		switch filepath.Clean(hdr.Name) {
+		case ociLayoutFile:
+			return true
+		case "manifest.json":
+			return false
+		}
+	}
+}
+
+// unpackArchive unpacks the directories and regular files of the tarball at
+// path into dir.
+func unpackArchive(path string, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %q: %w", path, err)
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading %q: %w", path, err)
+		}
+		p, err := securejoin.SecureJoin(dir, hdr.Name)
+		if err != nil {
+			return fmt.Errorf("invalid path %q in %q: %w", hdr.Name, path, err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return fmt.Errorf("failed to create directory %q: %w", p, err)
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				return fmt.Errorf("failed to create directory %q: %w", filepath.Dir(p), err)
+			}
+			if err := writeFile(p, tr); err != nil {
+				return err
+			}
+		default:
+			klog.Warningf("ignoring %q of unexpected type %d in %q", hdr.Name, hdr.Typeflag, path)
+		}
+	}
+}
+
+func writeFile(p string, r io.Reader) error {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %q: %w", p, err)
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %q: %w", p, err)
+	}
+	return nil
+}
+
+// readTarball returns the tagged images of a `docker save` tarball.
+func readTarball(path string) ([]importedImage, error) {
+	opener := func() (io.ReadCloser, error) {
+		return os.Open(path)
+	}
+	manifest, err := tarball.LoadManifest(opener)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest of tarball %q: %w", path, err)
+	}
+
+	var images []importedImage
+	for _, desc := range manifest {
+		for _, repoTag := range desc.RepoTags {
+			tag, err := name.NewTag(repoTag, name.StrictValidation)
+			if err != nil {
+				return nil, fmt.Errorf("tarball %q has invalid tag %q: %w", path, repoTag, err)
+			}
+			img, err := tarball.Image(opener, &tag)
+			if err != nil {
+				return nil, fmt.Errorf("error reading image %s of tarball %q: %w", repoTag, path, err)
+			}
+			digest, err := img.Digest()
+			if err != nil {
+				return nil, fmt.Errorf("error getting digest of image %s: %w", repoTag, err)
+			}
+			platform, err := configPlatform(img, hostPlatform())
+			if err != nil {
+				return nil, fmt.Errorf("image %s of tarball %q: %w", repoTag, path, err)
+			}
+			images = append(images, importedImage{ref: tag, img: img, digest: digest, platform: platform})
+		}
+	}
+	return images, nil
+}
+
+// configPlatform returns the platform img is built for, or fallback for
+// images whose config does not say.
+func configPlatform(img cranev1.Image, fallback cranev1.Platform) (cranev1.Platform, error) {
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return cranev1.Platform{}, fmt.Errorf("error getting config: %w", err)
+	}
+	return imagePlatform(configFile, fallback), nil
+}
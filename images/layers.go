@@ -0,0 +1,434 @@
+package images
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	cranev1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+
+	"k8s.io/klog/v2"
+)
+
+// layerStore holds unpacked image layers, keyed by their diffID, so that a
+// layer shared between images only has to be unpacked once.
+type layerStore struct {
+	dir string
+
+	// ids maps the owners of files in the layers to the host. Layers are
+	// unpacked once, so the mappings must not change for the lifetime of the
+	// store, which checkIDMappings enforces.
+	ids *idMapper
+
+	// locksDir holds the locks serializing the unpacking of each layer,
+	// which may be shared by images being extracted concurrently.
+	locksDir string
+
+	// cache is the layer cache the layers are read through.
+	cache cache.Cache
+
+	// pool, if not nil, deduplicates the files of the layers.
+	pool *objectPool
+}
+
+func (l *layerStore) path(diffID cranev1.Hash) string {
+	return filepath.Join(l.dir, diffID.Algorithm, diffID.Hex)
+}
+
+// unpack extracts the layer into the store, if it is not already there, and
+// returns the directory holding its contents.
+func (l *layerStore) unpack(ctx context.Context, layer cranev1.Layer, progress *layerProgress) (string, error) {
+	diffID, err := layer.DiffID()
+	if err != nil {
+		return "", fmt.Errorf("error getting diffID of layer: %w", err)
+	}
+
+	layerDir := l.path(diffID)
+	if isDir(layerDir) {
+		klog.V(2).Infof("layer %s is cached at %s", diffID, layerDir)
+		progress.done(true)
+		return layerDir, nil
+	}
+
+	lock, err := lockFile(ctx, filepath.Join(l.locksDir, layerLockName(diffID.String())), true)
+	if err != nil {
+		return "", err
+	}
+	defer lock.Unlock()
+
+	// Somebody else may have unpacked the layer while we waited for the lock.
+	if isDir(layerDir) {
+		klog.V(2).Infof("layer %s is cached at %s", diffID, layerDir)
+		progress.done(true)
+		return layerDir, nil
+	}
+
+	klog.Infof("unpacking layer %s", diffID)
+
+	if err := os.MkdirAll(filepath.Dir(layerDir), 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory %q: %w", filepath.Dir(layerDir), err)
+	}
+	tempDir, err := ioutil.TempDir(filepath.Dir(layerDir), "kontained")
+	if err != nil {
+		return "", fmt.Errorf("failed to create tempdir for layer: %w", err)
+	}
+	if err := os.Chmod(tempDir, 0755); err != nil {
+		os.RemoveAll(tempDir)
+		return "", fmt.Errorf("failed to chmod %q: %w", tempDir, err)
+	}
+
+	report, err := l.untarLayer(ctx, layer, tempDir, progress)
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return "", fmt.Errorf("failed to unpack layer %s: %w", diffID, err)
+	}
+	if len(report.SkippedDevices) != 0 {
+		klog.Warningf("layer %s contains %d device nodes which were not created because we are not privileged: %s",
+			diffID, len(report.SkippedDevices), strings.Join(report.SkippedDevices, ", "))
+	}
+
+	if l.pool != nil {
+		objects, err := l.pool.dedup(tempDir)
+		if err == nil {
+			err = l.pool.writeRefs(diffID, objects)
+		}
+		if err != nil {
+			os.RemoveAll(tempDir)
+			return "", err
+		}
+	}
+
+	if err := os.Rename(tempDir, layerDir); err != nil {
+		os.RemoveAll(tempDir)
+		return "", fmt.Errorf("failed to rename layer tempdir %q -> %q: %w", tempDir, layerDir, err)
+	}
+	progress.done(false)
+	return layerDir, nil
+}
+
+// untarLayer unpacks the layer into dir. The layer is read compressed, so
+// that the layer cache keeps the blob as it is in the registry and Export can
+// write it out again under the digest the manifest refers to. The
+// uncompressed contents are checked against the diffID of the layer, which
+// the layer store keys them by.
+func (l *layerStore) untarLayer(ctx context.Context, layer cranev1.Layer, dir string, progress *layerProgress) (*untarReport, error) {
+	digest, err := layer.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("error getting digest of layer: %w", err)
+	}
+	diffID, err := layer.DiffID()
+	if err != nil {
+		return nil, fmt.Errorf("error getting diffID of layer: %w", err)
+	}
+
+	rc, err := compressedLayer(ctx, layer)
+	if err != nil {
+		return nil, fmt.Errorf("error reading layer: %w", err)
+	}
+	report, err := untarCompressed(progress.reader(rc), dir, diffID, l.ids, progress.file)
+	if closeErr := rc.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// Don't keep a truncated or corrupt blob in the layer cache, or
+		// we would fail the same way on the next attempt.
+		if deleteErr := l.cache.Delete(digest); deleteErr != nil && deleteErr != cache.ErrNotFound {
+			klog.Warningf("unable to remove layer %s from the layer cache: %v", digest, deleteErr)
+		}
+		return nil, err
+	}
+	return report, nil
+}
+
+// untarCompressed unpacks a layer blob, which is usually gzip-compressed
+// but may not be, into dir. The blob is read to the end, so that it is
+// verified against its digest and cached in full, and its uncompressed
+// contents must have the given diffID.
+func untarCompressed(r io.Reader, dir string, diffID cranev1.Hash, ids *idMapper, onEntry func()) (*untarReport, error) {
+	if diffID.Algorithm != "sha256" {
+		return nil, fmt.Errorf("unsupported algorithm of diffID %s", diffID)
+	}
+	br := bufio.NewReader(r)
+	var tr io.Reader = br
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error reading layer: %w", err)
+	}
+	if bytes.Equal(magic, gzipMagic) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing layer: %w", err)
+		}
+		defer zr.Close()
+		tr = zr
+	}
+	h := sha256.New()
+	tr = io.TeeReader(tr, h)
+
+	report, err := untar(tar.NewReader(tr), dir, ids, onEntry)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+		return nil, fmt.Errorf("error reading layer: %w", err)
+	}
+	if _, err := io.Copy(ioutil.Discard, br); err != nil {
+		return nil, fmt.Errorf("error reading layer: %w", err)
+	}
+	if got := (cranev1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(h.Sum(nil))}); got != diffID {
+		return nil, fmt.Errorf("layer has diffID %s, but the image says %s", got, diffID)
+	}
+	return report, nil
+}
+
+// gzipMagic starts every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+const (
+	// whiteoutPrefix marks a file in a layer as deleting the file of the same
+	// name (without the prefix) from the layers below.
+	whiteoutPrefix = ".wh."
+	// whiteoutMetaPrefix is reserved for special whiteout files, which are not
+	// removals themselves.
+	whiteoutMetaPrefix = whiteoutPrefix + whiteoutPrefix
+	// whiteoutOpaqueDir marks the directory containing it as opaque: the
+	// contents of the directory in the layers below are hidden.
+	whiteoutOpaqueDir = whiteoutMetaPrefix + ".opq"
+)
+
+// applyLayers composes destDir out of the given unpacked layers, applied in
+// order from the bottom-most layer up, and returns how many files, other than
+// directories, it applied.
+func applyLayers(layerDirs []string, destDir string) (int, error) {
+	// As in untar, the metadata of directories is copied last, once all the
+	// layers are applied: an earlier layer may make a directory read-only
+	// which a later one adds to.
+	dirs := &appliedDirs{index: map[string]int{}}
+	files := 0
+	for _, layerDir := range layerDirs {
+		n, err := applyLayer(layerDir, destDir, dirs)
+		if err != nil {
+			return files, fmt.Errorf("failed to apply layer %q: %w", layerDir, err)
+		}
+		files += n
+	}
+
+	for i := len(dirs.dirs) - 1; i >= 0; i-- {
+		d := dirs.dirs[i]
+		// The directory may have been removed or replaced by a later layer.
+		if fi, err := os.Lstat(d.target); err != nil || !fi.IsDir() {
+			continue
+		}
+		if err := copyMetadata(d.src, d.target, d.fi); err != nil {
+			return files, err
+		}
+	}
+	return files, nil
+}
+
+// appliedDirs are the directories of the layers applied so far, in the order
+// they were first applied, each with the metadata of the topmost layer which
+// has it.
+type appliedDirs struct {
+	dirs  []appliedDir
+	index map[string]int
+}
+
+type appliedDir struct {
+	src    string
+	target string
+	fi     os.FileInfo
+}
+
+func (a *appliedDirs) add(d appliedDir) {
+	// Keeping the first position keeps parents ahead of their children.
+	if i, ok := a.index[d.target]; ok {
+		a.dirs[i] = d
+		return
+	}
+	a.index[d.target] = len(a.dirs)
+	a.dirs = append(a.dirs, d)
+}
+
+// applyLayer copies the contents of an unpacked layer on top of destDir,
+// following the OCI rules for whiteouts, opaque directories and entries that
+// replace an entry of a different type. The directories it applies are added
+// to dirs, for applyLayers to copy their metadata.
+// Files are hard-linked from the layer store where possible, so composing an
+// image out of already unpacked layers is cheap.
+//
+// filepath.Walk visits a directory before its contents, so by the time an
+// entry is applied all of its parents in destDir are real directories and
+// never symlinks that could point outside of destDir.
+// whiteoutTarget returns the path in destDir which the whiteout at rel, in a
+// layer applied to destDir, deletes. The directories of rel are directories
+// in destDir by the time the whiteout is applied, as applyLayer visits them
+// first, so only the name which is deleted can lead out of destDir.
+func whiteoutTarget(destDir string, rel string) (string, error) {
+	name := strings.TrimPrefix(filepath.Base(rel), whiteoutPrefix)
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", fmt.Errorf("invalid whiteout %q", rel)
+	}
+	deleted := filepath.Join(destDir, filepath.Dir(rel), name)
+	inside, err := filepath.Rel(destDir, deleted)
+	if err != nil || inside == "." || inside == ".." || strings.HasPrefix(inside, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("whiteout %q deletes %q, which is outside of %q", rel, deleted, destDir)
+	}
+	return deleted, nil
+}
+
+func applyLayer(layerDir string, destDir string, dirs *appliedDirs) (int, error) {
+	files := 0
+
+	err := filepath.Walk(layerDir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(layerDir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		target := filepath.Join(destDir, rel)
+
+		base := filepath.Base(rel)
+		if strings.HasPrefix(base, whiteoutMetaPrefix) {
+			// Opaque markers are handled when visiting the directory.
+			return nil
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			deleted, err := whiteoutTarget(destDir, rel)
+			if err != nil {
+				return err
+			}
+			if err := os.RemoveAll(deleted); err != nil {
+				return fmt.Errorf("failed to remove whiteout %q: %w", deleted, err)
+			}
+			return nil
+		}
+
+		existing, err := os.Lstat(target)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error doing stat(%q): %w", target, err)
+		}
+
+		if fi.IsDir() {
+			dirs.add(appliedDir{src: p, target: target, fi: fi})
+			if existing != nil && existing.IsDir() {
+				opaque, err := isOpaque(p)
+				if err != nil {
+					return err
+				}
+				if opaque {
+					if err := removeContents(target); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			if existing != nil {
+				if err := os.RemoveAll(target); err != nil {
+					return fmt.Errorf("failed to remove %q: %w", target, err)
+				}
+			}
+			if err := os.Mkdir(target, 0755); err != nil {
+				return fmt.Errorf("failed to make directory %q: %w", target, err)
+			}
+			return nil
+		}
+
+		if existing != nil {
+			if err := os.RemoveAll(target); err != nil {
+				return fmt.Errorf("failed to remove %q: %w", target, err)
+			}
+		}
+		files++
+		if err := os.Link(p, target); err != nil {
+			klog.V(4).Infof("unable to hard link %q -> %q, copying instead: %v", p, target, err)
+			return copyEntry(p, target, fi)
+		}
+		return nil
+	})
+	return files, err
+}
+
+func isOpaque(layerDir string) (bool, error) {
+	_, err := os.Lstat(filepath.Join(layerDir, whiteoutOpaqueDir))
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, fmt.Errorf("error checking for opaque marker in %q: %w", layerDir, err)
+}
+
+// removeContents removes everything inside dir, but not dir itself.
+func removeContents(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read directory %q: %w", dir, err)
+	}
+	for _, entry := range entries {
+		p := filepath.Join(dir, entry.Name())
+		if err := os.RemoveAll(p); err != nil {
+			return fmt.Errorf("failed to remove %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// copyEntry is the fallback for applyLayer when hard links are not possible,
+// e.g. because the layer store lives on a different filesystem.
+func copyEntry(src string, dest string, fi os.FileInfo) error {
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(src)
+		if err != nil {
+			return fmt.Errorf("failed to read symlink %q: %w", src, err)
+		}
+		if err := os.Symlink(target, dest); err != nil {
+			return fmt.Errorf("failed to make symlink %q -> %q: %w", dest, target, err)
+		}
+		return copyMetadata(src, dest, fi)
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("unable to copy %q with file type %v", src, fi.Mode().Type())
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error copying %q -> %q: %w", src, dest, err)
+	}
+	return copyMetadata(src, dest, fi)
+}
+
+func isDir(p string) bool {
+	stat, err := os.Stat(p)
+	return err == nil && stat.IsDir()
+}
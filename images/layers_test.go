@@ -0,0 +1,317 @@
+package images
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	cranev1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// entry is a tar entry of a synthetic layer: a directory if its name ends
+// with a slash, a file with the given contents otherwise.
+type entry struct {
+	name     string
+	contents string
+}
+
+func newLayer(t *testing.T, entries ...entry) cranev1.Layer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(e.contents))}
+		if strings.HasSuffix(e.name, "/") {
+			hdr = &tar.Header{Name: e.name, Typeflag: tar.TypeDir, Mode: 0755}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layer
+}
+
+// describe returns the entries under dir the way entry names them, leaving
+// out the files of random layers.
+func describe(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	got := map[string]string{}
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "random_file_") {
+			return err
+		}
+		if fi.IsDir() {
+			got[rel+"/"] = ""
+			return nil
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		got[rel] = string(b)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestApplyLayers(t *testing.T) {
+	tests := []struct {
+		name    string
+		layers  [][]entry
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "whiteout removes a file",
+			layers: [][]entry{
+				{{name: "etc/"}, {name: "etc/a", contents: "a"}, {name: "etc/b", contents: "b"}},
+				{{name: "etc/"}, {name: "etc/.wh.a"}},
+			},
+			want: map[string]string{"etc/": "", "etc/b": "b"},
+		},
+		{
+			name: "whiteout removes a directory",
+			layers: [][]entry{
+				{{name: "var/"}, {name: "var/cache/"}, {name: "var/cache/x", contents: "x"}},
+				{{name: "var/"}, {name: "var/.wh.cache"}},
+			},
+			want: map[string]string{"var/": ""},
+		},
+		{
+			name: "opaque directory hides the lower layers",
+			layers: [][]entry{
+				{{name: "opt/"}, {name: "opt/old", contents: "old"}, {name: "opt/sub/"}, {name: "opt/sub/deep", contents: "deep"}},
+				{{name: "opt/"}, {name: "opt/.wh..wh..opq"}, {name: "opt/new", contents: "new"}},
+			},
+			want: map[string]string{"opt/": "", "opt/new": "new"},
+		},
+		{
+			name: "opaque directory keeps what its own layer adds",
+			layers: [][]entry{
+				{{name: "opt/"}, {name: "opt/a", contents: "1"}},
+				{{name: "opt/"}, {name: "opt/a", contents: "2"}, {name: "opt/.wh..wh..opq"}},
+			},
+			want: map[string]string{"opt/": "", "opt/a": "2"},
+		},
+		{
+			name: "directory replaces a file",
+			layers: [][]entry{
+				{{name: "p", contents: "file"}},
+				{{name: "p/"}, {name: "p/q", contents: "q"}},
+			},
+			want: map[string]string{"p/": "", "p/q": "q"},
+		},
+		{
+			name: "file replaces a directory",
+			layers: [][]entry{
+				{{name: "p/"}, {name: "p/q", contents: "q"}},
+				{{name: "p", contents: "file"}},
+			},
+			want: map[string]string{"p": "file"},
+		},
+		{
+			name: "whiteouts of missing paths are ignored",
+			layers: [][]entry{
+				{{name: "a", contents: "a"}, {name: "d/"}},
+				{{name: ".wh.missing"}, {name: "d/"}, {name: "d/.wh.missing"}, {name: "d/.wh..wh..opq"}},
+			},
+			want: map[string]string{"a": "a", "d/": ""},
+		},
+		{
+			name: "whiteout and re-creation in a later layer",
+			layers: [][]entry{
+				{{name: "f", contents: "1"}},
+				{{name: ".wh.f"}},
+				{{name: "f", contents: "3"}},
+			},
+			want: map[string]string{"f": "3"},
+		},
+		{
+			name: "whiteout of the parent of the root",
+			layers: [][]entry{
+				{{name: "f", contents: "1"}},
+				{{name: ".wh..."}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "whiteout of the parent of a directory",
+			layers: [][]entry{
+				{{name: "d/"}, {name: "d/f", contents: "1"}},
+				{{name: "d/"}, {name: "d/.wh..."}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "whiteout of its own directory",
+			layers: [][]entry{
+				{{name: "d/"}, {name: "d/f", contents: "1"}},
+				{{name: "d/"}, {name: "d/.wh.."}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "whiteout with an empty name",
+			layers: [][]entry{
+				{{name: "d/"}, {name: "d/f", contents: "1"}},
+				{{name: "d/"}, {name: "d/.wh."}},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Every image starts with a random layer which the others do
+			// not touch.
+			base, err := random.Layer(64, types.DockerLayer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			layers := []cranev1.Layer{base}
+			for _, entries := range tt.layers {
+				layers = append(layers, newLayer(t, entries...))
+			}
+			img, err := mutate.AppendLayers(empty.Image, layers...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dir := t.TempDir()
+			s, err := NewStore(filepath.Join(dir, "store"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Whiteouts must not reach what is next to the root.
+			sibling := filepath.Join(dir, "sibling")
+			if err := ioutil.WriteFile(sibling, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			dest := filepath.Join(dir, "rootfs")
+			err = s.extractImage(context.Background(), tt.name, img, dest, nil)
+			if _, statErr := os.Stat(sibling); statErr != nil {
+				t.Errorf("extracting the image removed %q: %v", sibling, statErr)
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("extractImage succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extractImage: %v", err)
+			}
+
+			if got := describe(t, dest); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("extracted %v, want %v", got, tt.want)
+			}
+			randomFiles, err := filepath.Glob(filepath.Join(dest, "random_file_*"))
+			if err != nil || len(randomFiles) != 1 {
+				t.Errorf("got files %v of the random layer, want one", randomFiles)
+			}
+		})
+	}
+}
+
+// forgedLayer is a layer claiming the diffID of another one.
+type forgedLayer struct {
+	cranev1.Layer
+	diffID cranev1.Hash
+}
+
+func (l *forgedLayer) DiffID() (cranev1.Hash, error) {
+	return l.diffID, nil
+}
+
+// pushForgery pushes an image with the layer real, and one with a layer of
+// different contents which claims the diffID of real, to a new registry. It
+// returns the references of the real and forged images.
+func pushForgery(t *testing.T, real cranev1.Layer, forged cranev1.Layer) (name.Reference, name.Reference) {
+	t.Helper()
+	srv := httptest.NewServer(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))))
+	t.Cleanup(srv.Close)
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	diffID, err := real.DiffID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refs []name.Reference
+	for i, layer := range []cranev1.Layer{real, &forgedLayer{Layer: forged, diffID: diffID}} {
+		img, err := mutate.AppendLayers(empty.Image, layer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := name.ParseReference(host + "/forgery/image" + string(rune('a'+i)) + ":v1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := remote.Write(ref, img); err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, ref)
+	}
+	return refs[0], refs[1]
+}
+
+func TestExtractRejectsForgedDiffID(t *testing.T) {
+	realRef, forgedRef := pushForgery(t,
+		newLayer(t, entry{name: "bin/"}, entry{name: "bin/tool", contents: "real"}),
+		newLayer(t, entry{name: "bin/"}, entry{name: "bin/tool", contents: "forged"}))
+
+	s, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Extract(context.Background(), forgedRef.String()); err == nil || !strings.Contains(err.Error(), "diffID") {
+		t.Fatalf("Extract of the forged image returned %v, want a diffID mismatch", err)
+	}
+	extracted, err := s.Extract(context.Background(), realRef.String())
+	if err != nil {
+		t.Fatalf("Extract: %v", err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(extracted.ExtractedDir, "bin", "tool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "real" {
+		t.Errorf("bin/tool has %q, want %q", b, "real")
+	}
+}
@@ -0,0 +1,198 @@
+package images
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	cranev1 "github.com/google/go-containerregistry/pkg/v1"
+
+	"k8s.io/klog/v2"
+)
+
+// ImageSummary describes an image in the store.
+type ImageSummary struct {
+	Name   string
+	Digest string
+	// Platform is the platform the image was extracted for, as
+	// os/architecture[/variant]. It is empty for images extracted before the
+	// store kept images per platform.
+	Platform     string
+	Size         int64
+	ExtractedDir string
+	LastUsed     time.Time
+}
+
+// ImageDetails is everything the store knows about an image.
+type ImageDetails struct {
+	ImageSummary
+
+	// Layers are the diffIDs of the image layers, in order.
+	Layers []string
+	// Config is the image config. It is nil for images extracted before the
+	// store kept configs.
+	Config *cranev1.ConfigFile
+	// Manifest is the image manifest. It is nil for images extracted before
+	// the store kept manifests in their metadata.
+	Manifest *cranev1.Manifest
+}
+
+func (s *Store) summarize(image *storedImage) ImageSummary {
+	extractedDir := s.extractedPath(image.info)
+	size, err := diskUsage(extractedDir)
+	if err != nil {
+		klog.V(2).Infof("unable to compute size of %q: %v", extractedDir, err)
+	}
+	return ImageSummary{
+		Name:         image.info.Name,
+		Digest:       "sha256:" + image.info.Digest,
+		Platform:     image.info.Platform,
+		Size:         size,
+		ExtractedDir: extractedDir,
+		LastUsed:     image.lastUsed(),
+	}
+}
+
+// List returns all the images in the store.
+func (s *Store) List(ctx context.Context) ([]ImageSummary, error) {
+	lock, err := s.lockStore(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	images, err := s.listImages()
+	if err != nil {
+		return nil, err
+	}
+	var summaries []ImageSummary
+	for _, image := range images {
+		summaries = append(summaries, s.summarize(image))
+	}
+	return summaries, nil
+}
+
+// Inspect returns the details of an image, given by name or (a prefix of) its
+// digest. If the store has the image for several platforms, it is the one for
+// the platform we are running on, if any.
+func (s *Store) Inspect(ctx context.Context, nameOrDigest string) (*ImageDetails, error) {
+	lock, err := s.lockStore(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	images, err := s.findImages(nameOrDigest)
+	if err != nil {
+		return nil, err
+	}
+	image := images[0]
+	host := platformString(hostPlatform())
+	for _, candidate := range images {
+		if candidate.info.Platform == host {
+			image = candidate
+			break
+		}
+	}
+
+	details := &ImageDetails{
+		ImageSummary: s.summarize(image),
+		Layers:       image.info.Layers,
+		Config:       image.info.Config,
+		Manifest:     image.info.Manifest,
+	}
+	if details.Config == nil && image.info.ConfigDigest != "" {
+		h, err := cranev1.NewHash(image.info.ConfigDigest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config digest %q for image %s: %w", image.info.ConfigDigest, image.info.Name, err)
+		}
+		b, err := s.readBlob(h)
+		if err != nil {
+			return nil, fmt.Errorf("error reading config of image %s: %w", image.info.Name, err)
+		}
+		details.Config, err = cranev1.ParseConfigFile(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing config of image %s: %w", image.info.Name, err)
+		}
+	}
+	return details, nil
+}
+
+// Remove removes the images given by name or digest, for all platforms, along with the
+// extracted directories, layers, blobs and locks no other image uses. The
+// rest of the store is left for GC.
+//
+// The metadata file is removed first: once it is gone the image is no longer
+// in the store, and if we crash before the rest is cleaned up GC will remove
+// the leftovers.
+func (s *Store) Remove(ctx context.Context, nameOrDigest string) ([]string, error) {
+	lock, err := s.lockStore(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	images, err := s.findImages(nameOrDigest)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &GCResult{}
+	var removed []string
+	for _, image := range images {
+		if err := os.Remove(image.path); err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("failed to remove %q: %w", image.path, err)
+		}
+		removed = append(removed, image.info.Name)
+	}
+
+	remaining, err := s.listImages()
+	if err != nil {
+		return removed, err
+	}
+	if err := s.removeImageData(images, remaining, result); err != nil {
+		return removed, err
+	}
+	return removed, nil
+}
+
+// findImages returns the images matching nameOrDigest: an image reference, a
+// digest, or a unique prefix of a digest.
+func (s *Store) findImages(nameOrDigest string) ([]*storedImage, error) {
+	images, err := s.listImages()
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []*storedImage
+	if ref, err := name.ParseReference(nameOrDigest); err == nil {
+		for _, image := range images {
+			if image.info.Name == ref.Name() {
+				matches = append(matches, image)
+			}
+		}
+		if len(matches) != 0 {
+			return matches, nil
+		}
+	}
+
+	prefix := strings.TrimPrefix(nameOrDigest, "sha256:")
+	digests := map[string]bool{}
+	for _, image := range images {
+		if prefix != "" && strings.HasPrefix(image.info.Digest, prefix) {
+			matches = append(matches, image)
+			digests[image.info.Digest] = true
+		}
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("image %q not found in store", nameOrDigest)
+	}
+	if len(digests) > 1 {
+		return nil, fmt.Errorf("digest prefix %q is ambiguous", nameOrDigest)
+	}
+	return matches, nil
+}
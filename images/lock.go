@@ -0,0 +1,108 @@
+package images
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockPollInterval is how often a blocked lock is retried, so that waiting
+// for a lock can be cancelled through the context.
+const lockPollInterval = 100 * time.Millisecond
+
+// fileLock is an flock(2) lock on a file in the locks directory of the store.
+// flock locks belong to the open file, so they exclude other goroutines of
+// the same process holding their own fileLock as well as other processes.
+type fileLock struct {
+	f *os.File
+}
+
+// lockFile takes an exclusive or shared lock on p, creating it if needed,
+// and waits until the lock is acquired or ctx is done.
+func lockFile(ctx context.Context, p string, exclusive bool) (*fileLock, error) {
+	for {
+		lock, err := tryLockFile(p, exclusive)
+		if err != nil || lock != nil {
+			return lock, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for lock %q: %w", p, ctx.Err())
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// tryLockFile is lockFile without waiting: it returns a nil lock if the lock
+// is held by somebody else.
+func tryLockFile(p string, exclusive bool) (*fileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory %q: %w", filepath.Dir(p), err)
+	}
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file %q: %w", p, err)
+	}
+
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+	for {
+		err := unix.Flock(int(f.Fd()), how|unix.LOCK_NB)
+		if err == nil {
+			return &fileLock{f: f}, nil
+		}
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		f.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to lock %q: %w", p, err)
+	}
+}
+
+// Unlock releases the lock.
+func (l *fileLock) Unlock() error {
+	// Closing the file releases the lock.
+	return l.f.Close()
+}
+
+func (s *Store) locksDir() string {
+	return filepath.Join(s.baseDir, "locks")
+}
+
+// lockStore takes the store-wide lock. Operations adding to the store take it
+// shared, operations removing from the store (GC, Remove) take it exclusive so
+// they never delete what is being extracted.
+func (s *Store) lockStore(ctx context.Context, exclusive bool) (*fileLock, error) {
+	return lockFile(ctx, s.storeLockPath(), exclusive)
+}
+
+func (s *Store) storeLockPath() string {
+	return filepath.Join(s.locksDir(), storeLockName)
+}
+
+const storeLockName = "store.lock"
+
+// lockImage serializes pulling and extracting a single image reference.
+func (s *Store) lockImage(ctx context.Context, imageName string) (*fileLock, error) {
+	return lockFile(ctx, filepath.Join(s.locksDir(), imageLockName(imageName)), true)
+}
+
+// imageLockName and layerLockName are the names of the lock files of an image
+// reference and of an unpacked layer in the locks directory.
+func imageLockName(imageName string) string {
+	return "image-" + indexKey(imageName, "") + ".lock"
+}
+
+func layerLockName(diffID string) string {
+	return "layer-" + sanitize(diffID) + ".lock"
+}
@@ -0,0 +1,157 @@
+package images
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics are the Prometheus metrics of a store. They are a
+// prometheus.Collector, for the caller to register where it serves metrics.
+type Metrics struct {
+	cacheLookups    *prometheus.CounterVec
+	pullBytes       prometheus.Counter
+	pullDuration    *prometheus.HistogramVec
+	extractDuration prometheus.Histogram
+	extractFiles    prometheus.Histogram
+	gcReclaimed     prometheus.Counter
+}
+
+// NewMetrics returns the metrics for a store, to be passed to WithMetrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		cacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "runm",
+			Subsystem: "image_store",
+			Name:      "cache_lookups_total",
+			Help:      "Lookups of images in the store, by result: hit or miss.",
+		}, []string{"result"}),
+		pullBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "runm",
+			Subsystem: "image_store",
+			Name:      "pull_bytes_total",
+			Help:      "Bytes downloaded from registries.",
+		}),
+		pullDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "runm",
+			Subsystem: "image_store",
+			Name:      "pull_duration_seconds",
+			Help:      "Time taken to pull and extract images which were not in the store, by outcome: success or error.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+		}, []string{"outcome"}),
+		extractDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "runm",
+			Subsystem: "image_store",
+			Name:      "extract_duration_seconds",
+			Help:      "Time taken to unpack the layers of images and compose their root filesystems.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+		}),
+		extractFiles: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "runm",
+			Subsystem: "image_store",
+			Name:      "extract_files",
+			Help:      "Files, other than directories, applied to the root filesystems of extracted images.",
+			Buckets:   prometheus.ExponentialBuckets(10, 4, 8),
+		}),
+		gcReclaimed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "runm",
+			Subsystem: "image_store",
+			Name:      "gc_reclaimed_bytes_total",
+			Help:      "Disk space freed by garbage collection.",
+		}),
+	}
+}
+
+// WithMetrics makes the store record its metrics in m.
+func WithMetrics(m *Metrics) Option {
+	return func(s *Store) {
+		s.metrics = m
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.cacheLookups, m.pullBytes, m.pullDuration, m.extractDuration, m.extractFiles, m.gcReclaimed}
+}
+
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+// The methods below do nothing on a nil Metrics, which is what stores
+// without WithMetrics have.
+
+func (m *Metrics) cacheLookup(hit bool) {
+	if m == nil {
+		return
+	}
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.cacheLookups.WithLabelValues(result).Inc()
+}
+
+func (m *Metrics) pulled(start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	m.pullDuration.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+}
+
+func (m *Metrics) extracted(start time.Time, files int) {
+	if m == nil {
+		return
+	}
+	m.extractDuration.Observe(time.Since(start).Seconds())
+	m.extractFiles.Observe(float64(files))
+}
+
+func (m *Metrics) reclaimed(bytes int64) {
+	if m == nil || bytes <= 0 {
+		return
+	}
+	m.gcReclaimed.Add(float64(bytes))
+}
+
+// countingTransport counts the bytes of the responses of transport in
+// pullBytes.
+type countingTransport struct {
+	transport http.RoundTripper
+	metrics   *Metrics
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &countingBody{ReadCloser: resp.Body, counter: t.metrics.pullBytes}
+	return resp, nil
+}
+
+type countingBody struct {
+	io.ReadCloser
+	counter prometheus.Counter
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.counter.Add(float64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,127 @@
+package images
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// pulls returns the number of pulls observed with outcome.
+func pulls(t *testing.T, m *Metrics, outcome string) uint64 {
+	t.Helper()
+	var metric dto.Metric
+	if err := m.pullDuration.WithLabelValues(outcome).(prometheus.Histogram).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestExtractMetrics(t *testing.T) {
+	srv := httptest.NewServer(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	img, err := random.Image(1000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference(host + "/metrics/image:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMetrics()
+	s, err := NewStore(t.TempDir(), WithMetrics(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name string
+		// before prepares the store for the step.
+		before     func(t *testing.T, e *Extracted)
+		image      string
+		wantErr    bool
+		wantHits   float64
+		wantMisses float64
+		wantPulls  uint64
+		wantErrors uint64
+	}{
+		{
+			name:       "image not in the store",
+			image:      ref.String(),
+			wantMisses: 1,
+			wantPulls:  1,
+		},
+		{
+			name:       "image in the store",
+			image:      ref.String(),
+			wantHits:   1,
+			wantMisses: 1,
+			wantPulls:  1,
+		},
+		{
+			name: "metadata without a root filesystem",
+			before: func(t *testing.T, e *Extracted) {
+				if err := os.RemoveAll(e.ExtractedDir); err != nil {
+					t.Fatal(err)
+				}
+			},
+			image:      ref.String(),
+			wantHits:   1,
+			wantMisses: 2,
+			wantPulls:  2,
+		},
+		{
+			name:       "image not in the registry",
+			image:      host + "/metrics/missing:v1",
+			wantErr:    true,
+			wantHits:   1,
+			wantMisses: 3,
+			wantPulls:  2,
+			wantErrors: 1,
+		},
+	}
+
+	var last *Extracted
+	for _, step := range steps {
+		if step.before != nil {
+			step.before(t, last)
+		}
+		e, err := s.Extract(context.Background(), step.image)
+		if step.wantErr != (err != nil) {
+			t.Fatalf("%s: Extract returned %v, want an error: %t", step.name, err, step.wantErr)
+		}
+		if e != nil {
+			last = e
+		}
+
+		if got := testutil.ToFloat64(m.cacheLookups.WithLabelValues("hit")); got != step.wantHits {
+			t.Errorf("%s: got %v cache hits, want %v", step.name, got, step.wantHits)
+		}
+		if got := testutil.ToFloat64(m.cacheLookups.WithLabelValues("miss")); got != step.wantMisses {
+			t.Errorf("%s: got %v cache misses, want %v", step.name, got, step.wantMisses)
+		}
+		if got := pulls(t, m, "success"); got != step.wantPulls {
+			t.Errorf("%s: got %d successful pulls, want %d", step.name, got, step.wantPulls)
+		}
+		if got := pulls(t, m, "error"); got != step.wantErrors {
+			t.Errorf("%s: got %d failed pulls, want %d", step.name, got, step.wantErrors)
+		}
+	}
+}
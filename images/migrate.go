@@ -0,0 +1,288 @@
+package images
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	cranev1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"k8s.io/klog/v2"
+)
+
+// metadataMigration upgrades metadata from one format version to the next.
+type metadataMigration struct {
+	from, to string
+	// migrate fills in what version to has and from does not. It returns
+	// an error if that cannot be recovered from what the store has.
+	migrate func(s *Store, info *cachedImage) error
+}
+
+// metadataMigrations upgrade metadata of older versions, one version at a
+// time, to cachedImageFormatVersion. A format change which older metadata
+// can be upgraded to comes with a migration here.
+var metadataMigrations = []metadataMigration{
+	{from: "0.0.1", to: "0.0.2", migrate: migratePlatform},
+	{from: "0.0.2", to: "0.0.3", migrate: migrateConfigAndManifest},
+}
+
+// migrateMetadata upgrades the metadata in the file at p, read into info, to
+// the current format version, and writes it back. Metadata which cannot be
+// upgraded is left as it is, and the image has to be pulled again.
+func (s *Store) migrateMetadata(p string, info *cachedImage) error {
+	from := info.Version
+	if from == cachedImageFormatVersion {
+		return nil
+	}
+	upgraded := *info
+	for upgraded.Version != cachedImageFormatVersion {
+		migration := findMigration(upgraded.Version)
+		if migration == nil {
+			return fmt.Errorf("no migration of metadata version %q in %s", upgraded.Version, p)
+		}
+		if err := migration.migrate(s, &upgraded); err != nil {
+			return fmt.Errorf("error migrating %s from version %s to %s: %w", p, migration.from, migration.to, err)
+		}
+		upgraded.Version = migration.to
+	}
+
+	if err := writeMetadata(p, &upgraded); err != nil {
+		return err
+	}
+	*info = upgraded
+	klog.Infof("migrated metadata of image %s from version %s to %s", info.Name, from, info.Version)
+	return nil
+}
+
+func findMigration(from string) *metadataMigration {
+	for i := range metadataMigrations {
+		if metadataMigrations[i].from == from {
+			return &metadataMigrations[i]
+		}
+	}
+	return nil
+}
+
+// legacyPlatform is the platform of images pulled before the store knew about
+// platforms: go-containerregistry's default, unless the config says otherwise.
+func legacyPlatform(info *cachedImage) string {
+	fallback := cranev1.Platform{OS: "linux", Architecture: "amd64"}
+	if info.Config != nil {
+		return platformString(imagePlatform(info.Config, fallback))
+	}
+	return platformString(fallback)
+}
+
+// metadataPlatform returns the platform of the image described by info.
+func metadataPlatform(info *cachedImage) string {
+	if info.Platform == "" {
+		return legacyPlatform(info)
+	}
+	return info.Platform
+}
+
+// migratePlatform records the platform of images which 0.0.1 metadata, from
+// before the store was platform-aware, does not have.
+func migratePlatform(s *Store, info *cachedImage) error {
+	info.Platform = metadataPlatform(info)
+	return nil
+}
+
+// migrateConfigAndManifest fills in the config and manifest, which 0.0.3
+// keeps in the metadata, out of the blobs directory. Metadata from before the
+// store kept blobs gets a config made of what it has of it, and its manifest is
+// filled in by fillManifest once the image is used.
+func migrateConfigAndManifest(s *Store, info *cachedImage) error {
+	if info.Config == nil {
+		config, err := s.storedConfig(info)
+		if err != nil {
+			klog.V(2).Infof("rebuilding config of image %s from its metadata: %v", info.Name, err)
+			config = rebuiltConfig(info)
+		}
+		info.Config = config
+	}
+	if info.Manifest == nil {
+		manifest, err := s.storedManifest(info)
+		if err != nil {
+			klog.V(2).Infof("image %s has no manifest in the store yet: %v", info.Name, err)
+		}
+		info.Manifest = manifest
+	}
+	return nil
+}
+
+func (s *Store) storedConfig(info *cachedImage) (*cranev1.ConfigFile, error) {
+	if info.ConfigDigest == "" {
+		return nil, fmt.Errorf("image %s has no config digest", info.Name)
+	}
+	configDigest, err := cranev1.NewHash(info.ConfigDigest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config digest %q: %w", info.ConfigDigest, err)
+	}
+	b, err := s.readBlob(configDigest)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config: %w", err)
+	}
+	config, err := cranev1.ParseConfigFile(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config: %w", err)
+	}
+	return config, nil
+}
+
+func (s *Store) storedManifest(info *cachedImage) (*cranev1.Manifest, error) {
+	b, err := s.readBlob(cranev1.Hash{Algorithm: "sha256", Hex: info.Digest})
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	manifest, err := cranev1.ParseManifest(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// rebuiltConfig returns a config with what the metadata keeps of it.
+func rebuiltConfig(info *cachedImage) *cranev1.ConfigFile {
+	config := &cranev1.ConfigFile{
+		Config: cranev1.Config{
+			Env:        info.Env,
+			Cmd:        info.Command,
+			Entrypoint: info.Entrypoint,
+			WorkingDir: info.WorkingDir,
+		},
+	}
+	if platform, err := ParsePlatform(info.Platform); err == nil {
+		config.OS = platform.OS
+		config.Architecture = platform.Architecture
+	}
+	if len(info.Layers) != 0 {
+		config.RootFS.Type = "layers"
+		for _, layer := range info.Layers {
+			if diffID, err := cranev1.NewHash(layer); err == nil {
+				config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffID)
+			}
+		}
+	}
+	return config
+}
+
+// fillManifest fills in the manifest of an image whose metadata was migrated
+// without it, from the blobs directory or, unless policy is PullNever, from
+// the registry. The image can be used without it, so failing is not an error.
+func (s *Store) fillManifest(ctx context.Context, ref name.Reference, info *cachedImage, policy PullPolicy) {
+	manifest, err := s.storedManifest(info)
+	if err != nil && policy != PullNever {
+		manifest, err = s.fetchManifest(ctx, ref, info)
+	}
+	if err != nil {
+		klog.V(2).Infof("unable to fill in manifest of image %s: %v", info.Name, err)
+		return
+	}
+	info.Manifest = manifest
+}
+
+// fetchManifest fetches the manifest of the image described by info from the
+// registry, and keeps it in the blobs directory.
+func (s *Store) fetchManifest(ctx context.Context, ref name.Reference, info *cachedImage) (*cranev1.Manifest, error) {
+	digest := cranev1.Hash{Algorithm: "sha256", Hex: info.Digest}
+	sources, err := s.registries.sources(ref.Context().Digest(digest.String()))
+	if err != nil {
+		return nil, err
+	}
+	var errs []string
+	for _, source := range sources {
+		source, err := s.withTransportSettings(source)
+		if err != nil {
+			return nil, err
+		}
+		// Getting the manifest by digest checks its digest.
+		desc, err := remote.Get(source, s.remoteOptions(ctx)...)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		manifest, err := cranev1.ParseManifest(bytes.NewReader(desc.Manifest))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing manifest of %s: %w", source, err)
+		}
+		if err := s.writeBlob(digest, desc.Manifest); err != nil {
+			return nil, err
+		}
+		return manifest, nil
+	}
+	return nil, errors.New(strings.Join(errs, "; "))
+}
+
+// legacyExtractedName is the name of the directory in baseDir which stores
+// before the index extracted the image described by info to.
+func legacyExtractedName(info *cachedImage) string {
+	return sanitize(info.Name) + "_" + info.Digest
+}
+
+// migrateLayout moves the metadata files and extracted directories which
+// older stores kept right in baseDir, named after the sanitized reference,
+// into the index and rootfs directories. Metadata files which cannot be read
+// are left for fsck.
+func (s *Store) migrateLayout() error {
+	entries, err := ioutil.ReadDir(s.baseDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read directory %q: %w", s.baseDir, err)
+	}
+
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || isTempDir(entry.Name()) || reservedNames[entry.Name()] {
+			continue
+		}
+		p := filepath.Join(s.baseDir, entry.Name())
+		info, err := readMetadata(p)
+		if err != nil {
+			klog.V(2).Infof("not migrating unreadable metadata file %q: %v", p, err)
+			continue
+		}
+
+		// The index is keyed by platform, which metadata from before the
+		// store was platform-aware does not have.
+		info.Platform = metadataPlatform(info)
+
+		legacyDir := filepath.Join(s.baseDir, legacyExtractedName(info))
+		extractedDir := s.extractedPath(info)
+		if isDir(legacyDir) {
+			if isDir(extractedDir) {
+				if err := removeAll(legacyDir); err != nil {
+					return err
+				}
+			} else {
+				if err := os.MkdirAll(filepath.Dir(extractedDir), 0755); err != nil {
+					return fmt.Errorf("failed to create directory %q: %w", filepath.Dir(extractedDir), err)
+				}
+				if err := os.Rename(legacyDir, extractedDir); err != nil {
+					return fmt.Errorf("failed to rename %q -> %q: %w", legacyDir, extractedDir, err)
+				}
+			}
+		}
+
+		// Metadata already in the index is newer than what is left here.
+		indexed := filepath.Join(s.indexDir(), indexKey(info.Name, info.Platform))
+		if _, err := os.Stat(indexed); os.IsNotExist(err) {
+			if err := writeMetadata(indexed, info); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(p); err != nil {
+			return fmt.Errorf("failed to remove %q: %w", p, err)
+		}
+		klog.Infof("moved image %s into the store index", info.Name)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package images
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	cranev1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// TestNewStoreMigratesBaselineMetadata opens a store as the first version of
+// the store left it: metadata named after the sanitized reference, without a
+// platform, layers or blobs, next to the extracted image.
+func TestNewStoreMigratesBaselineMetadata(t *testing.T) {
+	const imageName = "gcr.io/kpt-fn/gatekeeper:v0"
+	digest := strings.Repeat("ab", 32)
+	dir := t.TempDir()
+
+	metadata := `{"name":"gcr.io/kpt-fn/gatekeeper:v0","version":"0.0.1","digest":"` + digest + `",` +
+		`"env":["PATH=/usr/local/bin:/usr/bin"],"command":["gatekeeper"],"entrypoint":null,"workingDir":"/app"}`
+	if err := ioutil.WriteFile(filepath.Join(dir, sanitize(imageName)), []byte(metadata), 0644); err != nil {
+		t.Fatal(err)
+	}
+	legacyDir := filepath.Join(dir, sanitize(imageName)+"_"+digest)
+	if err := os.MkdirAll(filepath.Join(legacyDir, "usr/local/bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(legacyDir, "usr/local/bin/gatekeeper"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewStore(dir)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	ctx := context.Background()
+
+	// The store pulled images for go-containerregistry's default platform.
+	extracted, err := s.Extract(ctx, imageName, WithPullPolicy(PullNever),
+		WithPlatform(cranev1.Platform{OS: "linux", Architecture: "amd64"}))
+	if err != nil {
+		t.Fatalf("Extract: %v", err)
+	}
+	if want := s.digestPath(digest); extracted.ExtractedDir != want {
+		t.Errorf("ExtractedDir = %q, want %q", extracted.ExtractedDir, want)
+	}
+	if _, hostPath, err := extracted.ResolveInPath("gatekeeper"); err != nil {
+		t.Errorf("ResolveInPath: %v", err)
+	} else if !strings.HasPrefix(hostPath, extracted.ExtractedDir) {
+		t.Errorf("ResolveInPath = %q, want a path in %q", hostPath, extracted.ExtractedDir)
+	}
+
+	config := extracted.ConfigFile()
+	if config == nil {
+		t.Fatal("ConfigFile() = nil, want a config rebuilt from the metadata")
+	}
+	if want := []string{"gatekeeper"}; !reflect.DeepEqual(config.Config.Cmd, want) {
+		t.Errorf("Cmd = %q, want %q", config.Config.Cmd, want)
+	}
+	if config.Config.WorkingDir != "/app" {
+		t.Errorf("WorkingDir = %q, want %q", config.Config.WorkingDir, "/app")
+	}
+	if config.Architecture != "amd64" {
+		t.Errorf("Architecture = %q, want %q", config.Architecture, "amd64")
+	}
+
+	info, err := readMetadata(s.metadataPath(imageName, cranev1.Platform{OS: "linux", Architecture: "amd64"}))
+	if err != nil {
+		t.Fatalf("reading migrated metadata: %v", err)
+	}
+	if info.Version != cachedImageFormatVersion {
+		t.Errorf("Version = %q, want %q", info.Version, cachedImageFormatVersion)
+	}
+
+	report, err := s.Fsck(ctx, false)
+	if err != nil {
+		t.Fatalf("Fsck: %v", err)
+	}
+	if len(report.Problems) != 0 {
+		t.Errorf("Fsck found problems in the migrated store: %+v", report.Problems)
+	}
+}
+
+// TestNewStoreKeepsMetadataFailingToMigrate checks that recovery leaves
+// metadata it cannot migrate, and its image, for Extract to pull again.
+func TestNewStoreKeepsMetadataFailingToMigrate(t *testing.T) {
+	saved := metadataMigrations
+	defer func() { metadataMigrations = saved }()
+	metadataMigrations = []metadataMigration{{
+		from: "0.0.1",
+		to:   cachedImageFormatVersion,
+		migrate: func(s *Store, info *cachedImage) error {
+			return os.ErrNotExist
+		},
+	}}
+
+	dir := t.TempDir()
+	s, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &cachedImage{
+		Name:     "example.com/foo:v1",
+		Version:  "0.0.1",
+		Digest:   strings.Repeat("cd", 32),
+		Platform: "linux/amd64",
+	}
+	p := filepath.Join(s.indexDir(), indexKey(info.Name, info.Platform))
+	if err := writeMetadata(p, info); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(s.extractedPath(info), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewStore(dir); err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	if _, err := os.Stat(p); err != nil {
+		t.Errorf("metadata was removed: %v", err)
+	}
+	if !isDir(s.extractedPath(info)) {
+		t.Errorf("extracted directory %q was removed", s.extractedPath(info))
+	}
+}
@@ -0,0 +1,260 @@
+package images
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/opencontainers/runc/libcontainer/configs"
+	"golang.org/x/sys/unix"
+
+	"k8s.io/klog/v2"
+)
+
+// overrideStatXattr is where the owner and mode from the image are recorded
+// when they cannot be applied to the file itself, e.g. when running rootless.
+// The format ("uid:gid:0mode") is the one used by fuse-overlayfs and
+// containers/storage.
+const overrideStatXattr = "user.containers.override_stat"
+
+// paxXattrPrefix is the prefix of PAX records holding extended attributes.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// idMapper translates the uids and gids found in image layers to the ids that
+// should own the files on the host, following the uid and gid mappings of the
+// container's user namespace.
+type idMapper struct {
+	uidMappings []configs.IDMap
+	gidMappings []configs.IDMap
+}
+
+// toHost returns the host uid and gid for a uid and gid of the container.
+// ok is false if either id is not covered by the mappings.
+func (m *idMapper) toHost(uid, gid int) (hostUID int, hostGID int, ok bool) {
+	if m == nil {
+		return uid, gid, true
+	}
+	hostUID, uidOK := hostID(m.uidMappings, uid)
+	hostGID, gidOK := hostID(m.gidMappings, gid)
+	return hostUID, hostGID, uidOK && gidOK
+}
+
+func hostID(mappings []configs.IDMap, id int) (int, bool) {
+	if len(mappings) == 0 {
+		return id, true
+	}
+	for _, m := range mappings {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return m.HostID + id - m.ContainerID, true
+		}
+	}
+	return -1, false
+}
+
+// idMappingsName is the file in baseDir recording the mappings the layers of
+// the store are unpacked with.
+const idMappingsName = "idmappings.json"
+
+// idMappingsRecord is the content of idMappingsName.
+type idMappingsRecord struct {
+	UIDMappings []configs.IDMap `json:"uidMappings,omitempty"`
+	GIDMappings []configs.IDMap `json:"gidMappings,omitempty"`
+}
+
+func (m *idMapper) record() idMappingsRecord {
+	if m == nil {
+		return idMappingsRecord{}
+	}
+	return idMappingsRecord{UIDMappings: m.uidMappings, GIDMappings: m.gidMappings}
+}
+
+// checkIDMappings records the id mappings of the store the first time it is
+// opened, and fails if it was opened with different ones before: layers are
+// unpacked once, with their owners mapped, so they are only good for the
+// mappings they were unpacked with.
+func (s *Store) checkIDMappings() error {
+	want, err := json.Marshal(s.ids.record())
+	if err != nil {
+		return fmt.Errorf("error converting id mappings to json: %w", err)
+	}
+	if err := os.MkdirAll(s.baseDir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %q: %w", s.baseDir, err)
+	}
+	p := filepath.Join(s.baseDir, idMappingsName)
+	err = createFileAtomic(p, want, 0644)
+	if err == nil || !os.IsExist(err) {
+		return err
+	}
+
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return fmt.Errorf("failed to read id mappings: %w", err)
+	}
+	var recorded idMappingsRecord
+	if err := json.Unmarshal(b, &recorded); err != nil {
+		return fmt.Errorf("failed to parse id mappings %q: %w", p, err)
+	}
+	got, err := json.Marshal(recorded)
+	if err != nil {
+		return fmt.Errorf("error converting id mappings to json: %w", err)
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("store %q was used with id mappings %s, not %s", s.baseDir, got, want)
+	}
+	return nil
+}
+
+// applyOwnership chowns p to the (mapped) owner from the tar header. If that
+// is not possible, the owner and mode are recorded in overrideStatXattr
+// instead.
+func applyOwnership(p string, f *tar.Header, ids *idMapper) error {
+	hostUID, hostGID, ok := ids.toHost(f.Uid, f.Gid)
+	if ok {
+		err := os.Lchown(p, hostUID, hostGID)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, unix.EPERM) && !errors.Is(err, unix.EINVAL) {
+			return fmt.Errorf("failed to chown %q: %w", p, err)
+		}
+	}
+
+	if f.Typeflag == tar.TypeSymlink {
+		// user.* xattrs are not allowed on symlinks.
+		return nil
+	}
+	mode := f.FileInfo().Mode()
+	value := fmt.Sprintf("%d:%d:0%o", f.Uid, f.Gid, unixPermissions(mode))
+	if err := unix.Lsetxattr(p, overrideStatXattr, []byte(value), 0); err != nil {
+		klog.V(2).Infof("unable to record owner %d:%d of %q: %v", f.Uid, f.Gid, p, err)
+	}
+	return nil
+}
+
+// applyXattrs sets the extended attributes recorded in the tar header, like
+// security.capability.
+func applyXattrs(p string, f *tar.Header) error {
+	for key, value := range f.PAXRecords {
+		if !strings.HasPrefix(key, paxXattrPrefix) {
+			continue
+		}
+		attr := strings.TrimPrefix(key, paxXattrPrefix)
+		if err := unix.Lsetxattr(p, attr, []byte(value), 0); err != nil {
+			// Unprivileged users cannot set security.* and trusted.*
+			// attributes, and not every filesystem supports xattrs.
+			if errors.Is(err, unix.EPERM) || errors.Is(err, unix.ENOTSUP) {
+				klog.Warningf("unable to set xattr %s on %q: %v", attr, p, err)
+				continue
+			}
+			return fmt.Errorf("failed to set xattr %s on %q: %w", attr, p, err)
+		}
+	}
+	return nil
+}
+
+// applyMode sets the permission bits, including setuid, setgid and sticky
+// bits, which are lost when creating the file (and by chown).
+func applyMode(p string, mode os.FileMode) error {
+	if mode&os.ModeSymlink != 0 {
+		return nil
+	}
+	if err := os.Chmod(p, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return fmt.Errorf("failed to chmod %q: %w", p, err)
+	}
+	return nil
+}
+
+// applyTimes sets the access and modification times without following
+// symlinks.
+func applyTimes(p string, atime time.Time, mtime time.Time) error {
+	if atime.IsZero() {
+		atime = mtime
+	}
+	ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, p, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return fmt.Errorf("failed to set times of %q: %w", p, err)
+	}
+	return nil
+}
+
+// copyMetadata copies owner, xattrs, mode and times from src to dest. The mode
+// comes after the xattrs, which cannot be set on files, like read-only
+// directories, which we may not write to.
+func copyMetadata(src string, dest string, fi os.FileInfo) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("unable to get owner of %q", src)
+	}
+
+	if err := os.Lchown(dest, int(st.Uid), int(st.Gid)); err != nil && !errors.Is(err, unix.EPERM) {
+		return fmt.Errorf("failed to chown %q: %w", dest, err)
+	}
+	if err := copyXattrs(src, dest); err != nil {
+		return err
+	}
+	if err := applyMode(dest, fi.Mode()); err != nil {
+		return err
+	}
+	return applyTimes(dest, time.Unix(st.Atim.Unix()), time.Unix(st.Mtim.Unix()))
+}
+
+func copyXattrs(src string, dest string) error {
+	size, err := unix.Llistxattr(src, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil
+		}
+		return fmt.Errorf("failed to list xattrs of %q: %w", src, err)
+	}
+	if size == 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(src, buf)
+	if err != nil {
+		return fmt.Errorf("failed to list xattrs of %q: %w", src, err)
+	}
+	for _, attr := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		valueSize, err := unix.Lgetxattr(src, attr, nil)
+		if err != nil {
+			return fmt.Errorf("failed to get xattr %s of %q: %w", attr, src, err)
+		}
+		value := make([]byte, valueSize)
+		valueSize, err = unix.Lgetxattr(src, attr, value)
+		if err != nil {
+			return fmt.Errorf("failed to get xattr %s of %q: %w", attr, src, err)
+		}
+		if err := unix.Lsetxattr(dest, attr, value[:valueSize], 0); err != nil {
+			if errors.Is(err, unix.EPERM) || errors.Is(err, unix.ENOTSUP) {
+				klog.Warningf("unable to set xattr %s on %q: %v", attr, dest, err)
+				continue
+			}
+			return fmt.Errorf("failed to set xattr %s on %q: %w", attr, dest, err)
+		}
+	}
+	return nil
+}
+
+// unixPermissions converts the permission bits of mode to their unix
+// representation.
+func unixPermissions(mode os.FileMode) uint32 {
+	perm := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		perm |= unix.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		perm |= unix.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		perm |= unix.S_ISVTX
+	}
+	return perm
+}
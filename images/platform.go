@@ -0,0 +1,154 @@
+package images
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	cranev1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// WithPlatform sets the platform Extract picks out of multi-platform images.
+// The default is the platform we are running on.
+func WithPlatform(platform cranev1.Platform) ExtractOption {
+	return func(o *extractOptions) {
+		o.platform = &platform
+	}
+}
+
+// hostPlatform returns the platform we are running on.
+func hostPlatform() cranev1.Platform {
+	return normalizePlatform(cranev1.Platform{
+		OS:           runtime.GOOS,
+		Architecture: runtime.GOARCH,
+		Variant:      cpuVariant(),
+	})
+}
+
+// cpuVariant returns the variant of the 32-bit ARM CPU we are running on.
+// The other architectures we run on have no variants worth telling apart.
+func cpuVariant() string {
+	if runtime.GOARCH != "arm" {
+		return ""
+	}
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) != "CPU architecture" {
+			continue
+		}
+		switch value := strings.TrimSpace(parts[1]); {
+		case strings.HasPrefix(value, "5"):
+			return "v5"
+		case strings.HasPrefix(value, "6"):
+			return "v6"
+		default:
+			// ARMv8 CPUs run 32-bit ARMv7 code.
+			return "v7"
+		}
+	}
+	return ""
+}
+
+// normalizePlatform returns platform with the names used in image indexes,
+// and without the variants which are implied by the architecture.
+func normalizePlatform(platform cranev1.Platform) cranev1.Platform {
+	platform.OS = strings.ToLower(platform.OS)
+	platform.Architecture = strings.ToLower(platform.Architecture)
+	platform.Variant = strings.ToLower(platform.Variant)
+	switch platform.Architecture {
+	case "x86_64", "x86-64":
+		platform.Architecture = "amd64"
+	case "aarch64":
+		platform.Architecture = "arm64"
+	case "i386":
+		platform.Architecture = "386"
+	}
+	switch {
+	case platform.Architecture == "arm64" && platform.Variant == "v8":
+		platform.Variant = ""
+	case platform.Architecture == "arm" && platform.Variant == "":
+		platform.Variant = "v7"
+	}
+	return platform
+}
+
+// platformString formats platform as os/architecture[/variant].
+func platformString(platform cranev1.Platform) string {
+	s := platform.OS + "/" + platform.Architecture
+	if platform.Variant != "" {
+		s += "/" + platform.Variant
+	}
+	return s
+}
+
+// ParsePlatform parses a platform written as os/architecture[/variant], like
+// "linux/arm/v7".
+func ParsePlatform(s string) (cranev1.Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return cranev1.Platform{}, fmt.Errorf("invalid platform %q, expected os/architecture[/variant]", s)
+	}
+	platform := cranev1.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+	return normalizePlatform(platform), nil
+}
+
+// imagePlatform returns the platform an image is built for, according to its
+// config, or fallback if the config does not say. Configs do not record the
+// variant, so that is taken from fallback when the architecture matches.
+func imagePlatform(configFile *cranev1.ConfigFile, fallback cranev1.Platform) cranev1.Platform {
+	if configFile.OS == "" || configFile.Architecture == "" {
+		return fallback
+	}
+	platform := normalizePlatform(cranev1.Platform{
+		OS:           configFile.OS,
+		Architecture: configFile.Architecture,
+	})
+	if platform.Architecture == fallback.Architecture {
+		platform.Variant = fallback.Variant
+	}
+	return platform
+}
+
+// imageForPlatform picks the image for platform out of a multi-platform
+// index.
+func imageForPlatform(idx cranev1.ImageIndex, platform cranev1.Platform) (cranev1.Image, error) {
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("error reading index: %w", err)
+	}
+	for _, desc := range manifest.Manifests {
+		if desc.Platform == nil || !platformMatches(*desc.Platform, platform) {
+			continue
+		}
+		if desc.MediaType.IsIndex() {
+			child, err := idx.ImageIndex(desc.Digest)
+			if err != nil {
+				return nil, fmt.Errorf("error reading index %s: %w", desc.Digest, err)
+			}
+			return imageForPlatform(child, platform)
+		}
+		return idx.Image(desc.Digest)
+	}
+	return nil, fmt.Errorf("no image found for platform %s", platformString(platform))
+}
+
+// platformMatches returns whether an image for have runs on want.
+func platformMatches(have cranev1.Platform, want cranev1.Platform) bool {
+	have, want = normalizePlatform(have), normalizePlatform(want)
+	if have.OS != want.OS || have.Architecture != want.Architecture {
+		return false
+	}
+	return want.Variant == "" || have.Variant == want.Variant
+}
@@ -0,0 +1,104 @@
+package images
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	cranev1 "github.com/google/go-containerregistry/pkg/v1"
+
+	"k8s.io/klog/v2"
+)
+
+// PullPolicy decides when Extract goes to the registry instead of using the
+// image in the store.
+type PullPolicy string
+
+const (
+	// PullDefault pulls ":latest" images every time and trusts the store
+	// for every other tag, and for imported images.
+	PullDefault PullPolicy = ""
+	// PullAlways pulls the image every time.
+	PullAlways PullPolicy = "Always"
+	// PullIfNotPresent only pulls images which are not in the store.
+	PullIfNotPresent PullPolicy = "IfNotPresent"
+	// PullNever never pulls, and fails for images which are not in the store.
+	PullNever PullPolicy = "Never"
+	// PullCheckDigest asks the registry which digest the tag points to,
+	// with a cheap manifest HEAD request, and only pulls when the tag moved.
+	// The answer is trusted for the store's digest check TTL.
+	PullCheckDigest PullPolicy = "CheckDigest"
+)
+
+// ExtractOption configures a single Extract call.
+type ExtractOption func(*extractOptions)
+
+type extractOptions struct {
+	pullPolicy PullPolicy
+	platform   *cranev1.Platform
+	progress   ProgressSink
+}
+
+// WithPullPolicy sets the pull policy for Extract.
+func WithPullPolicy(policy PullPolicy) ExtractOption {
+	return func(o *extractOptions) {
+		o.pullPolicy = policy
+	}
+}
+
+// WithDigestCheckTTL sets how long the digest a tag resolved to is trusted
+// by PullCheckDigest before asking the registry again. The default of zero
+// asks on every Extract.
+func WithDigestCheckTTL(ttl time.Duration) Option {
+	return func(s *Store) {
+		s.digestCheckTTL = ttl
+	}
+}
+
+// effectivePullPolicy resolves PullDefault for ref, given what the store has
+// for it (which may be nil).
+func effectivePullPolicy(ref name.Reference, policy PullPolicy, cached *cachedImage) PullPolicy {
+	if policy != PullDefault {
+		return policy
+	}
+	if cached != nil && cached.Imported {
+		return PullIfNotPresent
+	}
+	if ref.Identifier() == "latest" { // always lookup ":latest" image
+		return PullAlways
+	}
+	return PullIfNotPresent
+}
+
+// isCurrent returns whether the cached image can be used under policy. For
+// PullCheckDigest it checks with the registry whether the tag still points to
+// the cached image, and records when it did in cached.
+func (s *Store) isCurrent(ctx context.Context, ref name.Reference, cached *cachedImage, policy PullPolicy) bool {
+	if policy != PullCheckDigest {
+		return true
+	}
+	if _, ok := ref.(name.Digest); ok {
+		// Digests never move.
+		return true
+	}
+	if cached.RemoteDigest != "" && time.Since(cached.ResolvedAt) < s.digestCheckTTL {
+		return true
+	}
+
+	desc, err := s.headImage(ctx, ref)
+	if err != nil {
+		klog.Warningf("unable to check digest of %s, using the cached image: %v", ref.Name(), err)
+		return true
+	}
+	// Images pulled before the store recorded the digest of the reference
+	// were single-platform images if they have the digest of the image.
+	if cached.RemoteDigest == "" && desc.Digest.Hex == cached.Digest {
+		cached.RemoteDigest = desc.Digest.String()
+	}
+	if desc.Digest.String() != cached.RemoteDigest {
+		klog.Infof("image %s moved from %s to %s", ref.Name(), cached.RemoteDigest, desc.Digest)
+		return false
+	}
+	cached.ResolvedAt = time.Now()
+	return true
+}
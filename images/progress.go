@@ -0,0 +1,276 @@
+package images
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	cranev1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// ProgressPhase is a step of Extract.
+type ProgressPhase string
+
+const (
+	// PhaseResolve looks the image up in the registry.
+	PhaseResolve ProgressPhase = "resolve"
+	// PhaseLayer downloads and unpacks a layer. Its events report the bytes
+	// and files done so far.
+	PhaseLayer ProgressPhase = "layer"
+	// PhaseCompose composes the image out of its unpacked layers.
+	PhaseCompose ProgressPhase = "compose"
+	// PhaseDone is the last event of an Extract which succeeded.
+	PhaseDone ProgressPhase = "done"
+)
+
+// ProgressEvent reports the progress of Extract.
+type ProgressEvent struct {
+	Time  time.Time     `json:"time"`
+	Image string        `json:"image"`
+	Phase ProgressPhase `json:"phase"`
+
+	// The fields below are only set for PhaseLayer events.
+
+	// Layer is the digest of the layer, the LayerIndex-th (from 1) of the
+	// LayerCount layers of the image.
+	Layer      string `json:"layer,omitempty"`
+	LayerIndex int    `json:"layerIndex,omitempty"`
+	LayerCount int    `json:"layerCount,omitempty"`
+	// BytesDone and BytesTotal count the compressed bytes of the layer.
+	BytesDone  int64 `json:"bytesDone,omitempty"`
+	BytesTotal int64 `json:"bytesTotal,omitempty"`
+	// Files counts the files unpacked from the layer so far.
+	Files int64 `json:"files,omitempty"`
+	// LayerDone is set on the last event of a layer, and Cached with it if
+	// the layer was already unpacked in the store.
+	LayerDone bool `json:"layerDone,omitempty"`
+	Cached    bool `json:"cached,omitempty"`
+}
+
+// ProgressSink receives the progress events of Extract. Events are sent one
+// at a time, from the goroutine calling Extract or the goroutines it starts;
+// the events of layers downloaded concurrently are interleaved.
+type ProgressSink interface {
+	Progress(event ProgressEvent)
+}
+
+// WithProgress sends the progress events of Extract to sink. Callers sharing
+// the extraction of an image with a concurrent Extract call get no events.
+func WithProgress(sink ProgressSink) ExtractOption {
+	return func(o *extractOptions) {
+		o.progress = sink
+	}
+}
+
+// progressInterval is how often events are sent while a layer is read.
+const progressInterval = 100 * time.Millisecond
+
+// progressReporter sends the events of an Extract call to a sink. A nil
+// reporter drops them.
+type progressReporter struct {
+	sink  ProgressSink
+	image string
+	mu    sync.Mutex
+}
+
+func newProgressReporter(sink ProgressSink, image string) *progressReporter {
+	if sink == nil {
+		return nil
+	}
+	return &progressReporter{sink: sink, image: image}
+}
+
+func (p *progressReporter) send(event ProgressEvent) {
+	if p == nil {
+		return
+	}
+	event.Time = time.Now()
+	event.Image = p.image
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sink.Progress(event)
+}
+
+func (p *progressReporter) phase(phase ProgressPhase) {
+	p.send(ProgressEvent{Phase: phase})
+}
+
+// newLayerProgress returns the reporter for layer, the index-th (from 0) of
+// count layers.
+func newLayerProgress(p *progressReporter, layer cranev1.Layer, index, count int) *layerProgress {
+	if p == nil {
+		return nil
+	}
+	// Progress is best effort: without a digest or size the events just
+	// say less.
+	digest, _ := layer.Digest()
+	size, _ := layer.Size()
+	return &layerProgress{
+		reporter: p,
+		event: ProgressEvent{
+			Phase:      PhaseLayer,
+			Layer:      digest.String(),
+			LayerIndex: index + 1,
+			LayerCount: count,
+			BytesTotal: size,
+		},
+	}
+}
+
+// layerProgress reports the progress of a layer. A nil layerProgress drops
+// it.
+type layerProgress struct {
+	reporter *progressReporter
+	event    ProgressEvent
+	lastSent time.Time
+}
+
+// reader counts the bytes read from r.
+func (l *layerProgress) reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &progressReader{r: r, progress: l}
+}
+
+// file counts a file unpacked from the layer.
+func (l *layerProgress) file() {
+	if l == nil {
+		return
+	}
+	l.event.Files++
+}
+
+func (l *layerProgress) update() {
+	if time.Since(l.lastSent) < progressInterval {
+		return
+	}
+	l.lastSent = time.Now()
+	l.reporter.send(l.event)
+}
+
+// done reports that the layer is unpacked.
+func (l *layerProgress) done(cached bool) {
+	if l == nil {
+		return
+	}
+	l.event.LayerDone = true
+	l.event.Cached = cached
+	if cached {
+		l.event.BytesDone = l.event.BytesTotal
+	}
+	l.reporter.send(l.event)
+}
+
+type progressReader struct {
+	r        io.Reader
+	progress *layerProgress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.progress.event.BytesDone += int64(n)
+	r.progress.update()
+	return n, err
+}
+
+// NewJSONProgress returns a sink writing events to w as JSON lines, for
+// logs.
+func NewJSONProgress(w io.Writer) ProgressSink {
+	return &jsonProgress{encoder: json.NewEncoder(w)}
+}
+
+type jsonProgress struct {
+	encoder *json.Encoder
+}
+
+func (j *jsonProgress) Progress(event ProgressEvent) {
+	// Progress is best effort, so write errors are ignored.
+	_ = j.encoder.Encode(&event)
+}
+
+// NewProgressBar returns a sink drawing a progress bar for the layers of the
+// image on w, which should be a terminal.
+func NewProgressBar(w io.Writer) ProgressSink {
+	return &progressBar{w: w, layers: map[int]ProgressEvent{}}
+}
+
+type progressBar struct {
+	w io.Writer
+	// layers holds the last event of each layer, which may be downloaded
+	// concurrently, by index.
+	layers map[int]ProgressEvent
+	// drawing is set while the bar is on the current line.
+	drawing bool
+}
+
+const progressBarWidth = 30
+
+func (b *progressBar) Progress(event ProgressEvent) {
+	if event.Phase != PhaseLayer {
+		b.endLine()
+		switch event.Phase {
+		case PhaseResolve:
+			fmt.Fprintf(b.w, "resolving %s\n", event.Image)
+		case PhaseCompose:
+			fmt.Fprintf(b.w, "composing %s\n", event.Image)
+		case PhaseDone:
+			fmt.Fprintf(b.w, "extracted %s\n", event.Image)
+		}
+		return
+	}
+
+	b.layers[event.LayerIndex] = event
+	var done, cached int
+	var bytesDone, bytesTotal, files int64
+	for _, layer := range b.layers {
+		if layer.LayerDone {
+			done++
+		}
+		if layer.Cached {
+			cached++
+		}
+		bytesDone += layer.BytesDone
+		bytesTotal += layer.BytesTotal
+		files += layer.Files
+	}
+
+	filled := 0
+	if bytesTotal > 0 {
+		filled = int(bytesDone * progressBarWidth / bytesTotal)
+	}
+	if filled > progressBarWidth {
+		filled = progressBarWidth
+	}
+	fmt.Fprintf(b.w, "\r%d/%d layers (%d cached) [%s%s] %s/%s %d files",
+		done, event.LayerCount, cached,
+		strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled),
+		formatBytes(bytesDone), formatBytes(bytesTotal), files)
+	b.drawing = true
+	if done == event.LayerCount {
+		b.endLine()
+	}
+}
+
+func (b *progressBar) endLine() {
+	if b.drawing {
+		fmt.Fprintln(b.w)
+		b.drawing = false
+	}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
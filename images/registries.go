@@ -0,0 +1,156 @@
+package images
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// RegistriesConfig configures where images are pulled from, in the spirit of
+// containers-registries.conf(5). Images which no registry matches are pulled
+// from the registry in their reference.
+type RegistriesConfig struct {
+	Registries []RegistryConfig `json:"registries"`
+}
+
+// RegistryConfig configures the images whose repository starts with Prefix.
+type RegistryConfig struct {
+	// Prefix is a registry, like "gcr.io", or a repository prefix, like
+	// "gcr.io/kpt-fn". The longest matching prefix wins.
+	Prefix string `json:"prefix"`
+	// Location replaces Prefix in references to pull from, e.g.
+	// "internal.example/kpt-fn". It defaults to Prefix.
+	Location string `json:"location,omitempty"`
+	// Mirrors replace Prefix in references which are tried, in order,
+	// before Location.
+	Mirrors []MirrorConfig `json:"mirrors,omitempty"`
+	// Blocked refuses to pull matching images.
+	Blocked bool `json:"blocked,omitempty"`
+	// Insecure allows pulling from the registry of Location over plain HTTP,
+	// or over HTTPS without verifying its certificate.
+	Insecure bool `json:"insecure,omitempty"`
+}
+
+// MirrorConfig is a mirror of a registry.
+type MirrorConfig struct {
+	Location string `json:"location"`
+	// Insecure allows pulling from the registry of Location over plain HTTP,
+	// or over HTTPS without verifying its certificate.
+	Insecure bool `json:"insecure,omitempty"`
+}
+
+// LoadRegistriesConfig reads a RegistriesConfig from a JSON file.
+func LoadRegistriesConfig(path string) (*RegistriesConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading registries config: %w", err)
+	}
+	config := &RegistriesConfig{}
+	if err := json.Unmarshal(b, config); err != nil {
+		return nil, fmt.Errorf("error parsing registries config %q: %w", path, err)
+	}
+	for i, registry := range config.Registries {
+		if registry.Prefix == "" {
+			return nil, fmt.Errorf("registry %d in %q has no prefix", i, path)
+		}
+	}
+	return config, nil
+}
+
+// WithRegistriesConfig makes the store pull images from the mirrors and
+// locations config gives, and refuse to pull from blocked registries.
+func WithRegistriesConfig(config *RegistriesConfig) Option {
+	return func(s *Store) {
+		s.registries = config
+		for _, registry := range config.Registries {
+			if registry.Insecure {
+				location := registry.Location
+				if location == "" {
+					location = registry.Prefix
+				}
+				s.insecureRegistries[registryHost(location)] = true
+			}
+			for _, mirror := range registry.Mirrors {
+				if mirror.Insecure {
+					s.insecureRegistries[registryHost(mirror.Location)] = true
+				}
+			}
+		}
+	}
+}
+
+// lookup returns the registry config for repo, or nil if there is none.
+func (c *RegistriesConfig) lookup(repo name.Repository) *RegistryConfig {
+	if c == nil {
+		return nil
+	}
+	var match *RegistryConfig
+	matchLen := 0
+	for i := range c.Registries {
+		registry := &c.Registries[i]
+		prefix := normalizeRepositoryPrefix(registry.Prefix)
+		if hasRepositoryPrefix(repo.Name(), prefix) && len(prefix) > matchLen {
+			match, matchLen = registry, len(prefix)
+		}
+	}
+	return match
+}
+
+// sources returns the references to try, in order, to pull ref.
+func (c *RegistriesConfig) sources(ref name.Reference) ([]name.Reference, error) {
+	registry := c.lookup(ref.Context())
+	if registry == nil {
+		return []name.Reference{ref}, nil
+	}
+	if registry.Blocked {
+		return nil, fmt.Errorf("image %s is in blocked registry %q", ref.Name(), registry.Prefix)
+	}
+
+	var locations []string
+	for _, mirror := range registry.Mirrors {
+		locations = append(locations, mirror.Location)
+	}
+	location := registry.Location
+	if location == "" {
+		location = registry.Prefix
+	}
+	locations = append(locations, location)
+
+	prefix := normalizeRepositoryPrefix(registry.Prefix)
+	var sources []name.Reference
+	for _, location := range locations {
+		repo := location + strings.TrimPrefix(ref.Context().Name(), prefix)
+		source, err := rewriteReference(ref, repo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid location %q for registry %q: %w", location, registry.Prefix, err)
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// rewriteReference returns ref with its repository replaced by repo.
+func rewriteReference(ref name.Reference, repo string, opts ...name.Option) (name.Reference, error) {
+	if _, ok := ref.(name.Digest); ok {
+		return name.NewDigest(repo+"@"+ref.Identifier(), opts...)
+	}
+	return name.NewTag(repo+":"+ref.Identifier(), opts...)
+}
+
+// normalizeRepositoryPrefix spells Docker Hub the way name.Repository does.
+func normalizeRepositoryPrefix(prefix string) string {
+	prefix = strings.TrimSuffix(prefix, "/")
+	parts := strings.SplitN(prefix, "/", 2)
+	if parts[0] == "docker.io" {
+		parts[0] = name.DefaultRegistry
+	}
+	return strings.Join(parts, "/")
+}
+
+// hasRepositoryPrefix returns whether repo is prefix or a repository under it.
+func hasRepositoryPrefix(repo string, prefix string) bool {
+	return repo == prefix || strings.HasPrefix(repo, prefix+"/")
+}
@@ -0,0 +1,372 @@
+package images
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	cranev1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+
+	"k8s.io/klog/v2"
+)
+
+// partialSuffix marks blobs in the layer cache which are still being
+// downloaded. GC removes them with the other unreferenced cache entries.
+const partialSuffix = ".partial"
+
+// resumableImage returns img, pulled from repo, with its layers read through
+// the layer cache. Layers which are not in the cache are downloaded into it
+// with range requests, so that a download cut off midway, in this Extract or
+// an earlier one, carries on from where it stopped. Its layers must only be
+// read by layerStore.unpack, which holds the layer lock downloadBlob needs.
+func (s *Store) resumableImage(ctx context.Context, repo name.Repository, img cranev1.Image) cranev1.Image {
+	return &resumableImage{
+		Image: img,
+		s:     s,
+		ctx:   ctx,
+		repo:  repo,
+	}
+}
+
+type resumableImage struct {
+	cranev1.Image
+	s    *Store
+	ctx  context.Context
+	repo name.Repository
+
+	transportOnce sync.Once
+	transport     http.RoundTripper
+	transportErr  error
+}
+
+func (i *resumableImage) Layers() ([]cranev1.Layer, error) {
+	layers, err := i.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	for j, layer := range layers {
+		layers[j] = &resumableLayer{Layer: layer, image: i}
+	}
+	return layers, nil
+}
+
+func (i *resumableImage) LayerByDigest(h cranev1.Hash) (cranev1.Layer, error) {
+	layer, err := i.Image.LayerByDigest(h)
+	if err != nil {
+		return nil, err
+	}
+	return &resumableLayer{Layer: layer, image: i}, nil
+}
+
+func (i *resumableImage) LayerByDiffID(h cranev1.Hash) (cranev1.Layer, error) {
+	layer, err := i.Image.LayerByDiffID(h)
+	if err != nil {
+		return nil, err
+	}
+	return &resumableLayer{Layer: layer, image: i}, nil
+}
+
+// registryTransport returns the transport to fetch blobs from the registry
+// with, logged in for pulling from the repository of the image.
+func (i *resumableImage) registryTransport() (http.RoundTripper, error) {
+	i.transportOnce.Do(func() {
+		auth, err := i.s.auth.Resolve(i.repo)
+		if err != nil {
+			i.transportErr = fmt.Errorf("error resolving credentials for %s: %w", i.repo, err)
+			return
+		}
+		i.transport, i.transportErr = transport.NewWithContext(i.ctx, i.repo.Registry, auth, i.s.transport, []string{i.repo.Scope(transport.PullScope)})
+	})
+	return i.transport, i.transportErr
+}
+
+// fetchBlob requests the blob with the given digest from offset on.
+func (i *resumableImage) fetchBlob(ctx context.Context, digest cranev1.Hash, offset int64) (io.ReadCloser, error) {
+	t, err := i.registryTransport()
+	if err != nil {
+		return nil, err
+	}
+	u := url.URL{
+		Scheme: i.repo.Registry.Scheme(),
+		Host:   i.repo.RegistryStr(),
+		Path:   fmt.Sprintf("/v2/%s/blobs/%s", i.repo.RepositoryStr(), digest),
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := (&http.Client{Transport: t}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			resp.Body.Close()
+			return nil, &blobError{fmt.Errorf("unexpected Content-Range %q for offset %d", resp.Header.Get("Content-Range"), offset)}
+		}
+	case resp.StatusCode == http.StatusOK && offset > 0:
+		// The registry does not do ranges, so skip what we already have.
+		klog.V(2).Infof("registry %s ignored range request for blob %s", i.repo.RegistryStr(), digest)
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	case resp.StatusCode == http.StatusOK:
+	default:
+		defer resp.Body.Close()
+		return nil, &blobError{transport.CheckError(resp, http.StatusOK)}
+	}
+	return resp.Body, nil
+}
+
+// blobError is an error fetching a blob which retrying will not fix.
+type blobError struct {
+	err error
+}
+
+func (e *blobError) Error() string {
+	return e.err.Error()
+}
+
+func (e *blobError) Unwrap() error {
+	return e.err
+}
+
+// resumableLayer reads a layer out of the layer cache if it is there, and
+// downloads it into the cache otherwise.
+type resumableLayer struct {
+	cranev1.Layer
+	image *resumableImage
+}
+
+func (l *resumableLayer) Compressed() (io.ReadCloser, error) {
+	return l.compressed(l.image.ctx)
+}
+
+// compressed is Compressed, downloading the layer under ctx rather than the
+// context the image was pulled with.
+func (l *resumableLayer) compressed(ctx context.Context) (io.ReadCloser, error) {
+	digest, err := l.Digest()
+	if err != nil {
+		return nil, err
+	}
+	if cached, err := l.image.s.layerCache.Get(digest); err == nil {
+		return cached.Compressed()
+	} else if err != cache.ErrNotFound {
+		return nil, fmt.Errorf("error reading layer %s from cache: %w", digest, err)
+	}
+
+	size, err := l.Size()
+	if err != nil {
+		return nil, err
+	}
+	return l.image.s.downloadBlob(ctx, digest, size, l.image.fetchBlob)
+}
+
+// compressedLayer returns the compressed contents of layer, downloading it
+// under ctx if it is read through the layer cache.
+func compressedLayer(ctx context.Context, layer cranev1.Layer) (io.ReadCloser, error) {
+	if l, ok := layer.(*resumableLayer); ok {
+		return l.compressed(ctx)
+	}
+	return layer.Compressed()
+}
+
+// downloadBlob returns a reader of the blob with the given digest and size.
+// The blob is written to <digest>.partial in the layer cache as it is read,
+// and moved into the cache once it is read in full and verified. If there is
+// a partial download already, it is read back first and the rest is fetched
+// from where it stopped. Callers must keep others from downloading the same
+// blob at the same time, as layerStore.unpack does with the layer lock.
+func (s *Store) downloadBlob(ctx context.Context, digest cranev1.Hash, size int64, fetch func(ctx context.Context, digest cranev1.Hash, offset int64) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	cacheDir := filepath.Join(s.baseDir, "cache")
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory %q: %w", cacheDir, err)
+	}
+	// The layer cache names blobs by their digest.
+	p := filepath.Join(cacheDir, digest.String())
+	f, err := os.OpenFile(p+partialSuffix, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open partial download of blob %s: %w", digest, err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to stat partial download of blob %s: %w", digest, err)
+	}
+	if stat.Size() > size {
+		klog.Warningf("discarding partial download of blob %s: it is larger than the blob", digest)
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to truncate partial download of blob %s: %w", digest, err)
+		}
+	} else if stat.Size() > 0 {
+		klog.Infof("resuming download of blob %s at %d of %d bytes", digest, stat.Size(), size)
+	}
+
+	return &blobDownload{
+		ctx:       ctx,
+		fetch:     fetch,
+		policy:    s.retryPolicy,
+		digest:    digest,
+		size:      size,
+		path:      p,
+		file:      f,
+		hash:      sha256.New(),
+		replaying: true,
+	}, nil
+}
+
+// blobDownload reads a blob back from its partial download, then from the
+// registry, writing what it reads from the registry to the partial download.
+// When the registry cuts the download off, it fetches the rest with a range
+// request.
+type blobDownload struct {
+	ctx    context.Context
+	fetch  func(ctx context.Context, digest cranev1.Hash, offset int64) (io.ReadCloser, error)
+	policy RetryPolicy
+	digest cranev1.Hash
+	size   int64
+	// path is where the blob goes in the layer cache once it is verified.
+	path string
+
+	file *os.File
+	hash hash.Hash
+	// offset is how much of the blob has been read.
+	offset int64
+	// replaying is set while the partial download is read back.
+	replaying bool
+	body      io.ReadCloser
+	failures  int
+	done      bool
+}
+
+func (d *blobDownload) Read(p []byte) (int, error) {
+	for {
+		if d.done {
+			return 0, io.EOF
+		}
+		if d.replaying {
+			n, err := d.file.Read(p)
+			d.hash.Write(p[:n])
+			d.offset += int64(n)
+			if err == io.EOF {
+				d.replaying = false
+				err = nil
+			}
+			if n > 0 || err != nil {
+				return n, err
+			}
+			continue
+		}
+		if d.offset >= d.size {
+			return 0, d.finish()
+		}
+
+		if d.body == nil {
+			body, err := d.fetch(d.ctx, d.digest, d.offset)
+			if err != nil {
+				if err := d.failed(err); err != nil {
+					return 0, err
+				}
+				continue
+			}
+			d.body = body
+		}
+		n, err := d.body.Read(p)
+		if n > 0 {
+			if _, err := d.file.Write(p[:n]); err != nil {
+				return 0, fmt.Errorf("error writing partial download of blob %s: %w", d.digest, err)
+			}
+			d.hash.Write(p[:n])
+			d.offset += int64(n)
+		}
+		if err == io.EOF && d.offset < d.size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil && err != io.EOF {
+			d.body.Close()
+			d.body = nil
+			if err := d.failed(err); err != nil {
+				return n, err
+			}
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// failed decides whether the download goes on after err, waiting before it
+// does, and returns err if it does not.
+func (d *blobDownload) failed(err error) error {
+	var be *blobError
+	if d.ctx.Err() != nil || errors.As(err, &be) {
+		return fmt.Errorf("error downloading blob %s: %w", d.digest, err)
+	}
+	d.failures++
+	if d.failures >= d.policy.Attempts {
+		return fmt.Errorf("error downloading blob %s, giving up after %d attempts: %w", d.digest, d.failures, err)
+	}
+	delay := d.policy.backoff(d.failures)
+	klog.Warningf("download of blob %s failed at %d of %d bytes, resuming in %s: %v", d.digest, d.offset, d.size, delay, err)
+	return sleep(d.ctx, delay)
+}
+
+// finish checks the downloaded blob against its digest and moves it into the
+// layer cache.
+func (d *blobDownload) finish() error {
+	d.done = true
+	if d.body != nil {
+		d.body.Close()
+		d.body = nil
+	}
+	got := cranev1.Hash{Algorithm: "sha256", Hex: fmt.Sprintf("%x", d.hash.Sum(nil))}
+	if d.offset != d.size || got != d.digest {
+		d.file.Close()
+		os.Remove(d.file.Name())
+		return fmt.Errorf("downloaded blob %s has size %d and digest %s, want size %d", d.digest, d.offset, got, d.size)
+	}
+	if err := d.file.Sync(); err != nil {
+		d.file.Close()
+		return fmt.Errorf("failed to sync blob %s: %w", d.digest, err)
+	}
+	if err := d.file.Close(); err != nil {
+		return fmt.Errorf("failed to close blob %s: %w", d.digest, err)
+	}
+	if err := os.Rename(d.file.Name(), d.path); err != nil {
+		return fmt.Errorf("failed to rename %q -> %q: %w", d.file.Name(), d.path, err)
+	}
+	return io.EOF
+}
+
+func (d *blobDownload) Close() error {
+	if d.body != nil {
+		d.body.Close()
+		d.body = nil
+	}
+	if d.done {
+		return nil
+	}
+	// Keep what we have for the next attempt.
+	d.done = true
+	return d.file.Close()
+}
@@ -0,0 +1,142 @@
+package images
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// RetryPolicy configures how the store retries registry requests which fail
+// transiently, and resumes blob downloads which are cut off.
+type RetryPolicy struct {
+	// Attempts is how many times a request is tried, and how many times a
+	// blob download is resumed, before giving up.
+	Attempts int
+	// InitialBackoff is how long to wait before the first retry. The wait
+	// doubles with each retry, up to MaxBackoff.
+	InitialBackoff time.Duration
+	// MaxBackoff bounds the wait between retries.
+	MaxBackoff time.Duration
+	// MaxRetryAfter bounds how long to wait when a registry asks to with
+	// Retry-After, which may be longer than MaxBackoff. A registry asking to
+	// wait longer than this fails the request instead. Zero waits as long as
+	// the registry asks, or until the request is cancelled.
+	MaxRetryAfter time.Duration
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	Attempts:       5,
+	InitialBackoff: 250 * time.Millisecond,
+	MaxBackoff:     30 * time.Second,
+	MaxRetryAfter:  5 * time.Minute,
+}
+
+// WithRetryPolicy sets how the store retries registry requests. The default
+// tries 5 times, waiting from 250ms up to 30s in between, or up to 5m when
+// the registry asks to with Retry-After.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(s *Store) {
+		s.retryPolicy = policy
+	}
+}
+
+// backoff returns how long to wait before retrying after the given number of
+// failed attempts, with jitter so that clients do not retry in lockstep.
+func (p RetryPolicy) backoff(failures int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < failures && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryableStatus returns whether a response with the given status may
+// succeed if the request is sent again.
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryAfter returns how long the Retry-After header of resp asks to wait.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t), true
+	}
+	return 0, false
+}
+
+// retryTransport sends GET and HEAD requests again when the registry answers
+// with a status which may be transient, like 429 or 503. Network errors are
+// retried by the transport of go-containerregistry, and blob downloads cut
+// off midway are resumed by blobDownload.
+type retryTransport struct {
+	transport http.RoundTripper
+	policy    RetryPolicy
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if (req.Method != http.MethodGet && req.Method != http.MethodHead) || req.Body != nil {
+		return t.transport.RoundTrip(req)
+	}
+	for attempt := 1; ; attempt++ {
+		resp, err := t.transport.RoundTrip(req)
+		if err != nil || !retryableStatus(resp.StatusCode) || attempt >= t.policy.Attempts {
+			return resp, err
+		}
+
+		delay := t.policy.backoff(attempt)
+		if after, ok := retryAfter(resp); ok {
+			if t.policy.MaxRetryAfter > 0 && after > t.policy.MaxRetryAfter {
+				klog.Warningf("%s %s returned %s, retry after %s, which is more than the %s we wait", req.Method, req.URL.Redacted(), resp.Status, after, t.policy.MaxRetryAfter)
+				return resp, nil
+			}
+			if after > delay {
+				delay = after
+			}
+		}
+		// Drain a little of the body so that the connection can be reused.
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+
+		klog.V(2).Infof("%s %s returned %s, retrying in %s", req.Method, req.URL.Redacted(), resp.Status, delay)
+		if err := sleep(req.Context(), delay); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package images
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryTransportRetryAfter(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		// The policies all back off for less than the server asks.
+		policy     RetryPolicy
+		wantStatus int
+		wantWait   time.Duration
+	}{
+		{
+			name:       "Retry-After within MaxRetryAfter",
+			policy:     RetryPolicy{Attempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond, MaxRetryAfter: time.Minute},
+			wantStatus: http.StatusOK,
+			wantWait:   time.Second,
+		},
+		{
+			name:       "no MaxRetryAfter",
+			policy:     RetryPolicy{Attempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond},
+			wantStatus: http.StatusOK,
+			wantWait:   time.Second,
+		},
+		{
+			name:       "Retry-After beyond MaxRetryAfter",
+			policy:     RetryPolicy{Attempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond, MaxRetryAfter: 500 * time.Millisecond},
+			wantStatus: http.StatusTooManyRequests,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&requests, 0)
+			rt := &retryTransport{transport: http.DefaultTransport, policy: tt.policy}
+			req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			resp, err := rt.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if waited := time.Since(start); waited < tt.wantWait {
+				t.Errorf("waited %s before retrying, want at least %s", waited, tt.wantWait)
+			}
+		})
+	}
+}
@@ -2,19 +2,29 @@ package images
 
 import (
 	"context"
+	"crypto"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	securejoin "github.com/cyphar/filepath-securejoin"
 	"github.com/google/go-containerregistry/pkg/authn"
-	"github.com/google/go-containerregistry/pkg/crane"
 	"github.com/google/go-containerregistry/pkg/name"
 	cranev1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/cache"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/opencontainers/runc/libcontainer/configs"
 
 	"k8s.io/klog/v2"
 )
@@ -23,16 +33,115 @@ type Store struct {
 	baseDir string
 
 	layerCache cache.Cache
+
+	layers *layerStore
+
+	ids *idMapper
+
+	// extractCalls deduplicates concurrent Extract calls for the same image
+	// within this process; the image lock does the same across processes.
+	extractMu    sync.Mutex
+	extractCalls map[string]*extractCall
+
+	digestCheckTTL time.Duration
+
+	// signatureKeys are the keys images must be signed with, if any.
+	signatureKeys []crypto.PublicKey
+
+	registries *RegistriesConfig
+
+	// keychains, credentials and credentialHelpers configure how the store
+	// logs in to registries; auth combines them.
+	keychains         []authn.Keychain
+	credentials       map[string]authn.Authenticator
+	credentialHelpers map[string]string
+	auth              authn.Keychain
+
+	// insecureRegistries and caBundles configure transport, which the store
+	// talks to registries with. caBundles are keyed by registry, with the
+	// bundles for all registries under "".
+	insecureRegistries map[string]bool
+	caBundles          map[string][]string
+	transport          http.RoundTripper
+
+	// pullConcurrency is how many layers of an image are downloaded at once,
+	// and bandwidthLimit caps how fast, in bytes per second.
+	pullConcurrency int
+	bandwidthLimit  int64
+
+	retryPolicy RetryPolicy
+
+	dedup DedupMode
+
+	metrics *Metrics
+}
+
+// Option configures a Store.
+type Option func(*Store)
+
+// WithIDMappings makes the store map the owners of extracted files through
+// the uid and gid mappings of the container's user namespace, as needed when
+// running rootless. Owners that cannot be mapped are recorded in the
+// user.containers.override_stat xattr instead. A store cannot be opened with
+// different mappings later.
+func WithIDMappings(uidMappings, gidMappings []configs.IDMap) Option {
+	return func(s *Store) {
+		s.ids = &idMapper{
+			uidMappings: uidMappings,
+			gidMappings: gidMappings,
+		}
+	}
 }
 
-func NewStore(baseDir string) (*Store, error) {
+func NewStore(baseDir string, opts ...Option) (*Store, error) {
 	cacheDir := filepath.Join(baseDir, "cache")
 
 	layerCache := cache.NewFilesystemCache(cacheDir)
-	return &Store{
-		baseDir:    baseDir,
-		layerCache: layerCache,
-	}, nil
+	s := &Store{
+		baseDir:           baseDir,
+		layerCache:        layerCache,
+		credentials:       map[string]authn.Authenticator{},
+		credentialHelpers: map[string]string{},
+		extractCalls:      map[string]*extractCall{},
+
+		insecureRegistries: map[string]bool{},
+		caBundles:          map[string][]string{},
+		retryPolicy:        defaultRetryPolicy,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.auth = s.keychain()
+	transport, err := s.newTransport()
+	if err != nil {
+		return nil, err
+	}
+	s.transport = transport
+	s.layers = &layerStore{
+		dir:      filepath.Join(baseDir, "layers"),
+		ids:      s.ids,
+		locksDir: s.locksDir(),
+		cache:    layerCache,
+	}
+	if err := s.checkIDMappings(); err != nil {
+		return nil, err
+	}
+	switch s.dedup {
+	case DedupNone:
+	case DedupHardLink, DedupReflink:
+		s.layers.pool = &objectPool{
+			objectsDir: s.poolObjectsDir(),
+			refsDir:    s.poolRefsDir(),
+			mode:       s.dedup,
+		}
+	default:
+		return nil, fmt.Errorf("unknown dedup mode %q", s.dedup)
+	}
+
+	if err := s.recover(); err != nil {
+		return nil, fmt.Errorf("failed to recover store %q: %w", baseDir, err)
+	}
+	return s, nil
 }
 
 type cachedImage struct {
@@ -43,19 +152,141 @@ type cachedImage struct {
 	Command    []string `json:"command"`
 	Entrypoint []string `json:"entrypoint"`
 	WorkingDir string   `json:"workingDir"`
+	// Layers are the diffIDs of the image layers, in order.
+	Layers []string `json:"layers,omitempty"`
+	// LayerDigests are the digests of the compressed layer blobs, in order,
+	// which the layer cache keeps for Export.
+	LayerDigests []string `json:"layerDigests,omitempty"`
+	// ConfigDigest is the digest of the image config, which is kept in the
+	// blobs directory along with the manifest.
+	ConfigDigest string `json:"configDigest,omitempty"`
+	// LastUsed is when the image was last returned by Extract, for LRU
+	// eviction by GC.
+	LastUsed time.Time `json:"lastUsed"`
+	// RemoteDigest is the digest the registry returned for Name, which for
+	// a multi-platform image is the digest of the index rather than Digest.
+	RemoteDigest string `json:"remoteDigest,omitempty"`
+	// ResolvedAt is when the registry last confirmed that Name points to
+	// RemoteDigest.
+	ResolvedAt time.Time `json:"resolvedAt"`
+	// Imported is set for images loaded with Import rather than pulled,
+	// which are not looked up in the registry by default.
+	Imported bool `json:"imported,omitempty"`
+	// Platform is the platform the image was extracted for, as
+	// os/architecture[/variant]. The store keeps an image per name and
+	// platform.
+	Platform string `json:"platform,omitempty"`
+	// Verified is set for images whose signature was verified when they
+	// were pulled.
+	Verified bool `json:"verified,omitempty"`
+	// Config and Manifest are the complete image config and manifest. Env,
+	// Command, Entrypoint and WorkingDir above are copied out of Config.
+	Config   *cranev1.ConfigFile `json:"config,omitempty"`
+	Manifest *cranev1.Manifest   `json:"manifest,omitempty"`
+}
+
+// provenance records where an image in the store came from.
+type provenance struct {
+	// remoteDigest is the digest the registry returned for the reference.
+	// It is zero for images which were not pulled.
+	remoteDigest cranev1.Hash
+	// imported is set for images loaded with Import.
+	imported bool
+	// verified is set for images whose signature was verified.
+	verified bool
 }
 
-func (s *Store) pullImage(ctx context.Context, ref name.Reference) (cranev1.Image, error) {
+func (s *Store) remoteOptions(ctx context.Context) []remote.Option {
 	var options []remote.Option
-	options = append(options, remote.WithAuthFromKeychain(authn.DefaultKeychain))
-	img, err := remote.Image(ref, options...) //, o.remote...)
+	options = append(options, remote.WithAuthFromKeychain(s.auth))
+	options = append(options, remote.WithTransport(s.transport))
+	options = append(options, remote.WithContext(ctx))
+	return options
+}
 
+// pullImage fetches the image for platform, from the first of the sources
+// the registries config gives for ref which has it. It returns the image along
+// with the digest the registry has for ref and the reference it was pulled
+// from.
+func (s *Store) pullImage(ctx context.Context, ref name.Reference, platform cranev1.Platform) (cranev1.Image, cranev1.Hash, name.Reference, error) {
+	sources, err := s.registries.sources(ref)
 	if err != nil {
-		return nil, fmt.Errorf("error pulling %s: %w", ref, err)
+		return nil, cranev1.Hash{}, nil, err
+	}
+	var errs []string
+	for _, source := range sources {
+		source, err := s.withTransportSettings(source)
+		if err != nil {
+			return nil, cranev1.Hash{}, nil, err
+		}
+		img, digest, err := s.pullImageFrom(ctx, source, platform)
+		if err == nil {
+			if source.Name() != ref.Name() {
+				klog.Infof("pulled image %s from %s", ref.Name(), source.Name())
+			}
+			return img, digest, source, nil
+		}
+		if len(sources) > 1 {
+			klog.Warningf("unable to pull image %s from %s: %v", ref.Name(), source.Name(), err)
+		}
+		errs = append(errs, err.Error())
 	}
-	img = cache.Image(img, s.layerCache)
+	return nil, cranev1.Hash{}, nil, errors.New(strings.Join(errs, "; "))
+}
 
-	return img, nil
+func (s *Store) pullImageFrom(ctx context.Context, ref name.Reference, platform cranev1.Platform) (cranev1.Image, cranev1.Hash, error) {
+	desc, err := remote.Get(ref, s.remoteOptions(ctx)...) //, o.remote...)
+	if err != nil {
+		return nil, cranev1.Hash{}, fmt.Errorf("error pulling %s: %w", ref, err)
+	}
+	var img cranev1.Image
+	if desc.MediaType.IsIndex() {
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return nil, cranev1.Hash{}, fmt.Errorf("error pulling %s: %w", ref, err)
+		}
+		img, err = imageForPlatform(idx, platform)
+		if err != nil {
+			return nil, cranev1.Hash{}, fmt.Errorf("error pulling %s: %w", ref, err)
+		}
+	} else {
+		img, err = desc.Image()
+		if err != nil {
+			return nil, cranev1.Hash{}, fmt.Errorf("error pulling %s: %w", ref, err)
+		}
+		have, err := configPlatform(img, platform)
+		if err != nil {
+			return nil, cranev1.Hash{}, fmt.Errorf("error pulling %s: %w", ref, err)
+		}
+		// Storing it under the platform asked for would have it taken for
+		// the image of that platform.
+		if !platformMatches(have, platform) {
+			return nil, cranev1.Hash{}, fmt.Errorf("error pulling %s: image is for platform %s, not %s", ref, platformString(have), platformString(platform))
+		}
+	}
+	return img, desc.Digest, nil
+}
+
+// headImage returns the descriptor the first of the sources for ref which
+// has it returns.
+func (s *Store) headImage(ctx context.Context, ref name.Reference) (*cranev1.Descriptor, error) {
+	sources, err := s.registries.sources(ref)
+	if err != nil {
+		return nil, err
+	}
+	var errs []string
+	for _, source := range sources {
+		source, err := s.withTransportSettings(source)
+		if err != nil {
+			return nil, err
+		}
+		desc, err := remote.Head(source, s.remoteOptions(ctx)...)
+		if err == nil {
+			return desc, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return nil, errors.New(strings.Join(errs, "; "))
 }
 
 func sanitize(image string) string {
@@ -97,10 +328,127 @@ func (e *Extracted) Entrypoint() []string {
 	return e.info.Entrypoint
 }
 
-const cachedImageFormatVersion = "0.0.1"
+// ConfigFile returns a copy of the image config.
+func (e *Extracted) ConfigFile() *cranev1.ConfigFile {
+	if e.info.Config == nil {
+		return &cranev1.ConfigFile{}
+	}
+	return e.info.Config.DeepCopy()
+}
+
+// Manifest returns a copy of the image manifest.
+func (e *Extracted) Manifest() *cranev1.Manifest {
+	if e.info.Manifest == nil {
+		return &cranev1.Manifest{}
+	}
+	return e.info.Manifest.DeepCopy()
+}
+
+// Annotations returns the annotations of the image manifest.
+func (e *Extracted) Annotations() map[string]string {
+	return e.Manifest().Annotations
+}
+
+// config returns the runtime part of the image config.
+func (e *Extracted) config() cranev1.Config {
+	if e.info.Config == nil {
+		return cranev1.Config{}
+	}
+	return e.info.Config.Config
+}
+
+// User returns the user, as user[:group], the image runs as.
+func (e *Extracted) User() string {
+	return e.config().User
+}
+
+// Labels returns a copy of the labels of the image.
+func (e *Extracted) Labels() map[string]string {
+	return e.ConfigFile().Config.Labels
+}
+
+// ExposedPorts returns the ports the image listens on, as port/protocol.
+func (e *Extracted) ExposedPorts() []string {
+	return sortedKeys(e.config().ExposedPorts)
+}
+
+// Volumes returns the directories of the image which hold volumes.
+func (e *Extracted) Volumes() []string {
+	return sortedKeys(e.config().Volumes)
+}
+
+// StopSignal returns the signal to stop the image with, if not SIGTERM.
+func (e *Extracted) StopSignal() string {
+	return e.config().StopSignal
+}
 
-func (s *Store) checkCached(ctx context.Context, ref name.Reference) (*cachedImage, error) {
-	p := filepath.Join(s.baseDir, sanitize(ref.Name()))
+// Healthcheck returns how to check that the image is healthy, or nil.
+func (e *Extracted) Healthcheck() *cranev1.HealthConfig {
+	return e.config().Healthcheck.DeepCopy()
+}
+
+// OnBuild returns the instructions to run when building on top of the image.
+func (e *Extracted) OnBuild() []string {
+	return append([]string(nil), e.config().OnBuild...)
+}
+
+// History returns the history of the layers of the image.
+func (e *Extracted) History() []cranev1.History {
+	return e.ConfigFile().History
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// cachedImageFormatVersion is bumped whenever cachedImage changes in a way
+// that older metadata cannot be used as is. 0.0.2 keyed metadata by platform,
+// and 0.0.3 added Config and Manifest.
+const cachedImageFormatVersion = "0.0.3"
+
+// indexDir holds the metadata of the images in the store, one file per
+// image reference and platform.
+func (s *Store) indexDir() string {
+	return filepath.Join(s.baseDir, "index")
+}
+
+// rootfsDir holds the extracted images, as sha256/<hex> keyed by the image
+// digest, so that all the references to an image share its directory.
+func (s *Store) rootfsDir() string {
+	return filepath.Join(s.baseDir, "rootfs")
+}
+
+// indexKey names the metadata file for an image on a platform. The full
+// reference is hashed, rather than sanitized, so that different references
+// never share a file.
+func indexKey(imageName, platform string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(imageName+"\x00"+platform)))
+}
+
+// metadataPath returns the path of the metadata file for an image on a
+// platform.
+func (s *Store) metadataPath(imageName string, platform cranev1.Platform) string {
+	return filepath.Join(s.indexDir(), indexKey(imageName, platformString(platform)))
+}
+
+// extractedPath returns the directory the image described by info is
+// extracted to.
+func (s *Store) extractedPath(info *cachedImage) string {
+	return s.digestPath(info.Digest)
+}
+
+// digestPath returns the directory the image with the given sha256 digest is
+// extracted to.
+func (s *Store) digestPath(hex string) string {
+	return filepath.Join(s.rootfsDir(), "sha256", hex)
+}
+
+func readMetadata(p string) (*cachedImage, error) {
 	b, err := ioutil.ReadFile(p)
 	if err != nil {
 		return nil, err
@@ -110,20 +458,113 @@ func (s *Store) checkCached(ctx context.Context, ref name.Reference) (*cachedIma
 	if err := json.Unmarshal(b, &cached); err != nil {
 		return nil, err
 	}
+	return cached, nil
+}
+
+func writeMetadata(p string, info *cachedImage) error {
+	b, err := json.Marshal(&info)
+	if err != nil {
+		return fmt.Errorf("error converting image info to json: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return fmt.Errorf("failed to create directory %q: %w", filepath.Dir(p), err)
+	}
+	return writeFileAtomic(p, b, 0644)
+}
+
+// createFileAtomic creates p with the contents b, like writeFileAtomic, but
+// fails with an error satisfying os.IsExist if p already exists.
+func createFileAtomic(p string, b []byte, perm os.FileMode) error {
+	dir := filepath.Dir(p)
+	f, err := ioutil.TempFile(dir, "kontained")
+	if err != nil {
+		return fmt.Errorf("failed to create tempfile for %q: %w", p, err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing file %q: %w", p, err)
+	}
+	if err := os.Link(f.Name(), p); err != nil {
+		return err
+	}
+	return nil
+}
+
+// writeFileAtomic writes b to p such that, even if we crash, p either has
+// its old contents or all of b: b is written to a temporary file which is
+// synced and then renamed over p.
+func writeFileAtomic(p string, b []byte, perm os.FileMode) error {
+	dir := filepath.Dir(p)
+	f, err := ioutil.TempFile(dir, "kontained")
+	if err != nil {
+		return fmt.Errorf("failed to create tempfile for %q: %w", p, err)
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("error writing file %q: %w", p, err)
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to rename tempfile %q -> %q: %w", f.Name(), p, err)
+	}
+
+	// Make the rename itself durable.
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory %q: %w", dir, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory %q: %w", dir, err)
+	}
+	return nil
+}
+
+func (s *Store) checkCached(ctx context.Context, ref name.Reference, platform cranev1.Platform) (*cachedImage, error) {
+	p := s.metadataPath(ref.Name(), platform)
+	cached, err := readMetadata(p)
+	if err != nil {
+		return nil, err
+	}
 
 	if cached.Name != ref.Name() {
 		return nil, fmt.Errorf("name mismatch in %s", p)
 	}
 
-	if cached.Version != cachedImageFormatVersion {
-		return nil, fmt.Errorf("version was not expected version in %s", p)
+	if err := s.migrateMetadata(p, cached); err != nil {
+		return nil, err
+	}
+
+	if metadataPlatform(cached) != platformString(platform) {
+		return nil, fmt.Errorf("platform mismatch in %s", p)
 	}
 
 	return cached, nil
 }
 
-func (s *Store) writeToCache(ctx context.Context, ref name.Reference, img cranev1.Image, configFile *cranev1.ConfigFile) (*cachedImage, error) {
-	p := filepath.Join(s.baseDir, sanitize(ref.Name()))
+func (s *Store) writeToCache(ctx context.Context, ref name.Reference, img cranev1.Image, configFile *cranev1.ConfigFile, platform cranev1.Platform, from provenance) (*cachedImage, error) {
+	p := s.metadataPath(ref.Name(), platform)
 
 	digest, err := img.Digest()
 	if err != nil {
@@ -137,44 +578,185 @@ func (s *Store) writeToCache(ctx context.Context, ref name.Reference, img cranev
 		Command:    configFile.Config.Cmd,
 		Entrypoint: configFile.Config.Entrypoint,
 		WorkingDir: configFile.Config.WorkingDir,
+		LastUsed:   time.Now(),
+		Imported:   from.imported,
+		Platform:   platformString(platform),
+		Verified:   from.verified,
+	}
+
+	if from.remoteDigest != (cranev1.Hash{}) {
+		info.RemoteDigest = from.remoteDigest.String()
+		info.ResolvedAt = time.Now()
 	}
 
 	info.Env = configFile.Config.Env
 
-	b, err := json.Marshal(&info)
+	for _, diffID := range configFile.RootFS.DiffIDs {
+		info.Layers = append(info.Layers, diffID.String())
+	}
+
+	manifest, err := img.Manifest()
 	if err != nil {
-		return nil, fmt.Errorf("error converting image info to json: %w", err)
+		return nil, fmt.Errorf("error getting manifest of image: %w", err)
+	}
+	for _, layer := range manifest.Layers {
+		info.LayerDigests = append(info.LayerDigests, layer.Digest.String())
+	}
+	info.Config = configFile
+	info.Manifest = manifest
+
+	configDigest, err := s.saveBlobs(img)
+	if err != nil {
+		return nil, err
 	}
+	info.ConfigDigest = configDigest.String()
 
-	if err := ioutil.WriteFile(p, b, 0644); err != nil {
-		return nil, fmt.Errorf("error writing file %q: %w", p, err)
+	if err := writeMetadata(p, info); err != nil {
+		return nil, err
 	}
 	return info, nil
 }
 
-func (s *Store) Extract(ctx context.Context, imageName string) (*Extracted, error) {
+func (s *Store) Extract(ctx context.Context, imageName string, opts ...ExtractOption) (*Extracted, error) {
 	ref, err := name.ParseReference(imageName) //, o.name...)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing image %q: %w", imageName, err)
 	}
 
-	sanitized := sanitize(ref.Name())
+	o := &extractOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	platform := hostPlatform()
+	if o.platform != nil {
+		platform = normalizePlatform(*o.platform)
+	}
+	key := extractKey(ref, platform, o.pullPolicy)
+	call, shared := s.joinExtract(key, func(ctx context.Context) (*Extracted, error) {
+		return s.extract(ctx, ref, imageName, platform, o.pullPolicy, newProgressReporter(o.progress, ref.Name()))
+	})
+	if shared {
+		klog.V(2).Infof("sharing extraction of image %s with a concurrent caller", ref.Name())
+	}
+	select {
+	case <-ctx.Done():
+		s.leaveExtract(key, call)
+		return nil, fmt.Errorf("error extracting image %s: %w", ref.Name(), ctx.Err())
+	case <-call.done:
+		s.leaveExtract(key, call)
+		if call.err != nil {
+			return nil, call.err
+		}
+		extracted := *call.extracted
+		extracted.ImageName = imageName
+		return &extracted, nil
+	}
+}
+
+// extractKey identifies the Extract calls which can share an extraction.
+func extractKey(ref name.Reference, platform cranev1.Platform, policy PullPolicy) string {
+	return ref.Name() + " " + platformString(platform) + " " + string(policy)
+}
+
+// extractCall is an extraction shared by the Extract calls for the same
+// image. It runs under its own context, as the caller who started it may go
+// away before the others, which is cancelled once they all have.
+type extractCall struct {
+	cancel  context.CancelFunc
+	waiters int
+
+	// done is closed once extracted and err are set.
+	done      chan struct{}
+	extracted *Extracted
+	err       error
+}
+
+// joinExtract returns the extraction in progress for key, or starts one
+// running fn if there is none. It returns whether the extraction was in
+// progress already. The caller must leaveExtract once it no longer waits for
+// the result.
+func (s *Store) joinExtract(key string, fn func(ctx context.Context) (*Extracted, error)) (*extractCall, bool) {
+	s.extractMu.Lock()
+	defer s.extractMu.Unlock()
+	if call, ok := s.extractCalls[key]; ok {
+		call.waiters++
+		return call, true
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	call := &extractCall{cancel: cancel, waiters: 1, done: make(chan struct{})}
+	s.extractCalls[key] = call
+	go func() {
+		call.extracted, call.err = fn(ctx)
+		s.extractMu.Lock()
+		if s.extractCalls[key] == call {
+			delete(s.extractCalls, key)
+		}
+		s.extractMu.Unlock()
+		cancel()
+		close(call.done)
+	}()
+	return call, false
+}
+
+// leaveExtract stops waiting for call, cancelling it if nobody else waits.
+func (s *Store) leaveExtract(key string, call *extractCall) {
+	s.extractMu.Lock()
+	defer s.extractMu.Unlock()
+	call.waiters--
+	if call.waiters > 0 {
+		return
+	}
+	call.cancel()
+	// Later callers start over rather than join a cancelled extraction.
+	if s.extractCalls[key] == call {
+		delete(s.extractCalls, key)
+	}
+}
+
+func (s *Store) extract(ctx context.Context, ref name.Reference, imageName string, platform cranev1.Platform, policy PullPolicy, progress *progressReporter) (*Extracted, error) {
+	storeLock, err := s.lockStore(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer storeLock.Unlock()
+
+	imageLock, err := s.lockImage(ctx, ref.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer imageLock.Unlock()
 
 	var cached *cachedImage
 
-	tag := ref.Identifier()
-	if tag != "latest" { // always lookup ":latest" image
-		cached, err = s.checkCached(ctx, ref)
+	// A lookup is only a hit if the cached image is what we return.
+	hit := false
+	if policy != PullAlways {
+		defer func() { s.metrics.cacheLookup(hit) }()
+		cached, err = s.checkCached(ctx, ref, platform)
 		if err != nil {
 			klog.V(2).Infof("ignoring error looking up image in cache: %v", err)
 			cached = nil
 		}
 	}
+	if cached != nil && s.verifySignatures() && !cached.Verified {
+		// The image was pulled or imported without verifying its
+		// signature, so we can't use it.
+		klog.Infof("image %s in the store is not verified", ref.Name())
+		if policy == PullNever {
+			return nil, fmt.Errorf("image %s in the store is not verified and the pull policy is %s", ref.Name(), policy)
+		}
+		cached = nil
+	}
+	// The effective policy depends on the cached image, but once it says to
+	// pull, the cached image must not be used.
+	policy = effectivePullPolicy(ref, policy, cached)
+	if policy == PullAlways {
+		cached = nil
+	}
 
 	if cached != nil {
-		imgHex := cached.Digest
-
-		imageExtracted := filepath.Join(s.baseDir, sanitized+"_"+imgHex)
+		imageExtracted := s.extractedPath(cached)
 
 		stat, err := os.Stat(imageExtracted)
 		if err != nil {
@@ -185,9 +767,19 @@ func (s *Store) Extract(ctx context.Context, imageName string) (*Extracted, erro
 			}
 		}
 
-		if stat != nil && stat.IsDir() {
+		if stat != nil && stat.IsDir() && s.isCurrent(ctx, ref, cached, policy) {
 			klog.V(2).Infof("image %s is cached at %s", imageName, imageExtracted)
+			progress.phase(PhaseDone)
+
+			if cached.Manifest == nil {
+				s.fillManifest(ctx, ref, cached, policy)
+			}
+			cached.LastUsed = time.Now()
+			if err := writeMetadata(s.metadataPath(ref.Name(), platform), cached); err != nil {
+				klog.Warningf("unable to record last use of image %s: %v", imageName, err)
+			}
 
+			hit = true
 			return &Extracted{
 				ImageName:    imageName,
 				ExtractedDir: imageExtracted,
@@ -196,12 +788,43 @@ func (s *Store) Extract(ctx context.Context, imageName string) (*Extracted, erro
 		}
 	}
 
-	klog.Infof("pulling image %s", ref.Name())
-	img, err := s.pullImage(ctx, ref)
+	if policy == PullNever {
+		return nil, fmt.Errorf("image %s is not in the store and the pull policy is %s", ref.Name(), policy)
+	}
+
+	klog.Infof("pulling image %s for %s", ref.Name(), platformString(platform))
+	progress.phase(PhaseResolve)
+	start := time.Now()
+	extracted, err := s.pullAndExtract(ctx, ref, imageName, platform, progress)
+	s.metrics.pulled(start, err)
+	return extracted, err
+}
+
+// pullAndExtract pulls the image ref for platform from its registry, verifies
+// it if the store requires signatures, and extracts it. The caller must hold
+// the store and image locks.
+func (s *Store) pullAndExtract(ctx context.Context, ref name.Reference, imageName string, platform cranev1.Platform, progress *progressReporter) (*Extracted, error) {
+	img, remoteDigest, source, err := s.pullImage(ctx, ref, platform)
 	if err != nil {
 		return nil, err
 	}
 
+	from := provenance{remoteDigest: remoteDigest}
+	if s.verifySignatures() {
+		if err := s.verifyImage(ctx, source, remoteDigest, img); err != nil {
+			return nil, err
+		}
+		from.verified = true
+	}
+
+	img = s.resumableImage(ctx, source.Context(), img)
+	return s.extractAndRecord(ctx, ref, imageName, img, platform, from, progress)
+}
+
+// extractAndRecord extracts img and writes its metadata, making it the image
+// the store has for ref on platform. The caller must hold the store and image
+// locks.
+func (s *Store) extractAndRecord(ctx context.Context, ref name.Reference, imageName string, img cranev1.Image, platform cranev1.Platform, from provenance, progress *progressReporter) (*Extracted, error) {
 	configFile, err := img.ConfigFile()
 	if err != nil {
 		return nil, fmt.Errorf("could not get config for image: %w", err)
@@ -212,18 +835,19 @@ func (s *Store) Extract(ctx context.Context, imageName string) (*Extracted, erro
 		return nil, fmt.Errorf("could not get digest for image: %w", err)
 	}
 
-	imageExtracted := filepath.Join(s.baseDir, sanitized+"_"+imgHash.Hex)
+	imageExtracted := s.digestPath(imgHash.Hex)
 
-	if err := s.extractImage(ctx, imageName, img, imageExtracted); err != nil {
+	if err := s.extractImage(ctx, imageName, img, imageExtracted, progress); err != nil {
 		return nil, err
 	}
 
 	klog.Infof("image %s is at %s", imageName, imageExtracted)
 
-	info, err := s.writeToCache(ctx, ref, img, configFile)
+	info, err := s.writeToCache(ctx, ref, img, configFile, platform, from)
 	if err != nil {
 		return nil, err
 	}
+	progress.phase(PhaseDone)
 
 	return &Extracted{
 		ImageName:    imageName,
@@ -232,11 +856,25 @@ func (s *Store) Extract(ctx context.Context, imageName string) (*Extracted, erro
 	}, nil
 }
 
-func (i *Extracted) ResolveInPath(bin string) (string, error) {
-	if filepath.IsAbs(bin) {
-		// TODO: check exists etc?
-		return bin, nil
+// ResolveInPath finds the executable bin in the image the way the container
+// would: bin is looked up in the PATH of the image unless it has a slash, and
+// relative paths are relative to the working directory. Symlinks are
+// followed within the extracted directory, never out to the host. It returns
+// the path of bin in the container, and the path of the file it resolves to
+// on the host.
+func (i *Extracted) ResolveInPath(bin string) (containerPath, hostPath string, err error) {
+	if strings.Contains(bin, "/") {
+		containerPath = path.Join("/", i.info.WorkingDir, bin)
+		if path.IsAbs(bin) {
+			containerPath = path.Clean(bin)
+		}
+		hostPath, err = i.resolveExecutable(containerPath)
+		if err != nil {
+			return "", "", err
+		}
+		return containerPath, hostPath, nil
 	}
+
 	envpath := "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
 	for _, env := range i.info.Env {
 		if strings.HasPrefix(env, "PATH=") {
@@ -245,34 +883,74 @@ func (i *Extracted) ResolveInPath(bin string) (string, error) {
 		}
 	}
 
+	// As with execvp, a file which is not executable is only an error if
+	// nothing further along the path is.
+	var permErr error
 	for _, pathDir := range filepath.SplitList(envpath) {
-		pathDir = strings.TrimLeft(pathDir, string(filepath.Separator))
-
-		p := filepath.Join(i.ExtractedDir, pathDir, bin)
-		stat, err := os.Stat(p)
-		if err != nil {
-			if os.IsNotExist(err) {
-				stat = nil
-			} else {
-				return "", fmt.Errorf("error from stat(%q): %w", p, err)
+		containerPath = path.Join("/", pathDir, bin)
+		hostPath, err = i.resolveExecutable(containerPath)
+		if err == nil {
+			return containerPath, hostPath, nil
+		}
+		if errors.Is(err, os.ErrPermission) {
+			if permErr == nil {
+				permErr = err
 			}
+			continue
 		}
-		// TODO: Check executable?
-		if stat != nil && !stat.IsDir() {
-			return filepath.Join(string(filepath.Separator)+pathDir, bin), nil
+		if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, syscall.ENOTDIR) {
+			return "", "", err
 		}
 	}
-	return "", fmt.Errorf("unable to find %q in path %q for image %q", bin, envpath, i.ImageName)
+	if permErr != nil {
+		return "", "", permErr
+	}
+	return "", "", fmt.Errorf("unable to find %q in path %q for image %q: %w", bin, envpath, i.ImageName, os.ErrNotExist)
 }
 
-func (s *Store) Pull(name string, os string, arch string) (cranev1.Image, error) {
-	img, err := crane.Pull(name, crane.WithPlatform(&cranev1.Platform{
+// resolveExecutable returns the host path of the executable at containerPath,
+// following symlinks within the extracted directory.
+func (i *Extracted) resolveExecutable(containerPath string) (string, error) {
+	hostPath, err := securejoin.SecureJoin(i.ExtractedDir, containerPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %q in image %q: %w", containerPath, i.ImageName, err)
+	}
+	// SecureJoin has resolved all the symlinks it could, so one left over
+	// dangles.
+	stat, err := os.Lstat(hostPath)
+	if err != nil {
+		return "", fmt.Errorf("error from stat(%q): %w", hostPath, err)
+	}
+	if !stat.Mode().IsRegular() {
+		return "", fmt.Errorf("%q in image %q is not a regular file: %w", containerPath, i.ImageName, os.ErrNotExist)
+	}
+	if stat.Mode().Perm()&0111 == 0 {
+		return "", fmt.Errorf("%q in image %q is not executable: %w", containerPath, i.ImageName, os.ErrPermission)
+	}
+	return hostPath, nil
+}
+
+// Pull fetches the image for the platform os/arch, honouring the registries
+// config and the signature keys of the store. Its layers are read from the
+// registry rather than through the layer cache.
+func (s *Store) Pull(imageName string, os string, arch string) (cranev1.Image, error) {
+	ctx := context.Background()
+	ref, err := name.ParseReference(imageName)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing image %q: %w", imageName, err)
+	}
+	platform := normalizePlatform(cranev1.Platform{
 		OS:           os,
 		Architecture: arch,
-	}))
+	})
+	img, remoteDigest, source, err := s.pullImage(ctx, ref, platform)
 	if err != nil {
-		return nil, fmt.Errorf("failed to pull %q: %w", name, err)
+		return nil, fmt.Errorf("failed to pull %q: %w", imageName, err)
+	}
+	if s.verifySignatures() {
+		if err := s.verifyImage(ctx, source, remoteDigest, img); err != nil {
+			return nil, err
+		}
 	}
-	img = cache.Image(img, s.layerCache)
 	return img, nil
 }
@@ -0,0 +1,294 @@
+package images
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/opencontainers/runc/libcontainer/configs"
+)
+
+// waiters returns how many Extract calls wait for the extraction of key.
+func waiters(s *Store, key string) int {
+	s.extractMu.Lock()
+	defer s.extractMu.Unlock()
+	if call, ok := s.extractCalls[key]; ok {
+		return call.waiters
+	}
+	return 0
+}
+
+func TestSharedExtractionCancellation(t *testing.T) {
+	tests := []struct {
+		name string
+		// others is how many callers wait for the extraction with the
+		// one which gives up.
+		others int
+	}{
+		{name: "other callers wait", others: 1},
+		{name: "nobody else waits", others: 0},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				holding      int32
+				manifestGets int32
+				started      = make(chan struct{})
+				canceled     = make(chan struct{})
+				release      = make(chan struct{})
+				once         sync.Once
+				releaseOnce  sync.Once
+			)
+			reg := registry.New(registry.Logger(log.New(ioutil.Discard, "", 0)))
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Hold pulls of the manifest until the test releases
+				// them or the client gives up.
+				if atomic.LoadInt32(&holding) == 1 && r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/manifests/") {
+					if atomic.AddInt32(&manifestGets, 1) == 1 {
+						once.Do(func() { close(started) })
+						select {
+						case <-release:
+						case <-r.Context().Done():
+							close(canceled)
+							return
+						}
+					}
+				}
+				reg.ServeHTTP(w, r)
+			}))
+			defer srv.Close()
+			// Closing the server waits for the requests it holds.
+			defer releaseOnce.Do(func() { close(release) })
+			host := strings.TrimPrefix(srv.URL, "http://")
+
+			img, err := random.Image(1000, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ref, err := name.ParseReference(host + "/shared/image" + string(rune('a'+i)) + ":v1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := remote.Write(ref, img); err != nil {
+				t.Fatal(err)
+			}
+			atomic.StoreInt32(&holding, 1)
+
+			s, err := NewStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := extractKey(ref, hostPlatform(), PullDefault)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			errs := make(chan error, 1)
+			go func() {
+				_, err := s.Extract(ctx, ref.String())
+				errs <- err
+			}()
+			<-started
+			others := make(chan error, tt.others)
+			for j := 0; j < tt.others; j++ {
+				go func() {
+					_, err := s.Extract(context.Background(), ref.String())
+					others <- err
+				}()
+			}
+			for waiters(s, key) != 1+tt.others {
+				time.Sleep(time.Millisecond)
+			}
+
+			cancel()
+			select {
+			case err := <-errs:
+				if !errors.Is(err, context.Canceled) {
+					t.Fatalf("Extract returned %v, want %v", err, context.Canceled)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("Extract did not return when its context was canceled")
+			}
+
+			if tt.others == 0 {
+				// The extraction stops with its last caller.
+				select {
+				case <-canceled:
+				case <-time.After(10 * time.Second):
+					t.Fatal("the pull went on after every caller gave up")
+				}
+				return
+			}
+
+			// The other callers keep the extraction going.
+			releaseOnce.Do(func() { close(release) })
+			for j := 0; j < tt.others; j++ {
+				if err := <-others; err != nil {
+					t.Errorf("Extract: %v", err)
+				}
+			}
+			if got := atomic.LoadInt32(&manifestGets); got != 1 {
+				t.Errorf("manifest was pulled %d times, want once", got)
+			}
+		})
+	}
+}
+
+func TestExtractFollowsMovedLatestTag(t *testing.T) {
+	srv := httptest.NewServer(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	s, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		tag string
+		// wantMoved is whether Extract with the default pull policy
+		// follows the tag to its new image.
+		wantMoved bool
+	}{
+		{tag: "latest", wantMoved: true},
+		{tag: "v1", wantMoved: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tag, func(t *testing.T) {
+			ref, err := name.ParseReference(host + "/moving/image:" + tt.tag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var dirs []string
+			for i := 0; i < 2; i++ {
+				img, err := random.Image(1000, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := remote.Write(ref, img); err != nil {
+					t.Fatal(err)
+				}
+				extracted, err := s.Extract(context.Background(), ref.String())
+				if err != nil {
+					t.Fatalf("Extract: %v", err)
+				}
+				dirs = append(dirs, extracted.ExtractedDir)
+			}
+			if moved := dirs[0] != dirs[1]; moved != tt.wantMoved {
+				t.Errorf("Extract after the tag moved returned %s, then %s; want it to follow the tag: %t", dirs[0], dirs[1], tt.wantMoved)
+			}
+		})
+	}
+}
+
+func TestNewStoreChecksIDMappings(t *testing.T) {
+	mapping := func(hostID int) Option {
+		ids := []configs.IDMap{{ContainerID: 0, HostID: hostID, Size: 65536}}
+		return WithIDMappings(ids, ids)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		first  []Option
+		second []Option
+		ok     bool
+	}{
+		{name: "no mappings", ok: true},
+		{name: "same mappings", first: []Option{mapping(100000)}, second: []Option{mapping(100000)}, ok: true},
+		{name: "empty mappings", first: []Option{WithIDMappings(nil, nil)}, ok: true},
+		{name: "different mappings", first: []Option{mapping(100000)}, second: []Option{mapping(200000)}},
+		{name: "mappings added", second: []Option{mapping(100000)}},
+		{name: "mappings dropped", first: []Option{mapping(100000)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := NewStore(dir, tc.first...)
+			if err != nil {
+				t.Fatalf("NewStore: %v", err)
+			}
+			// The record is not an image to clean up.
+			if _, err := s.Fsck(context.Background(), true); err != nil {
+				t.Fatalf("Fsck: %v", err)
+			}
+			if _, err := s.GC(context.Background(), GCPolicy{}); err != nil {
+				t.Fatalf("GC: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, idMappingsName)); err != nil {
+				t.Fatalf("id mappings were not recorded: %v", err)
+			}
+
+			_, err = NewStore(dir, tc.second...)
+			if tc.ok && err != nil {
+				t.Errorf("reopening the store: %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Errorf("reopening the store with different id mappings succeeded")
+			}
+		})
+	}
+}
+
+func TestPulledImageBypassesTheLayerCache(t *testing.T) {
+	srv := httptest.NewServer(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	ref, err := name.ParseReference(host + "/pulled/image:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := random.Image(1000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	s, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pulled, err := s.Pull(ref.String(), runtime.GOOS, runtime.GOARCH)
+	if err != nil {
+		t.Fatalf("Pull: %v", err)
+	}
+	layers, err := pulled.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without the layer lock, which only Extract takes, reading the layers
+	// must not download them into the store.
+	for _, layer := range layers {
+		rc, err := layer.Compressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(ioutil.Discard, rc); err != nil {
+			t.Fatal(err)
+		}
+		rc.Close()
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "cache"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("reading the layers of a pulled image wrote %s to the layer cache", entry.Name())
+	}
+}
@@ -0,0 +1,147 @@
+package images
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// WithInsecureRegistry allows pulling from registry, given as host[:port],
+// over plain HTTP, or over HTTPS without verifying its certificate.
+func WithInsecureRegistry(registry string) Option {
+	return func(s *Store) {
+		s.insecureRegistries[registryKey(registry)] = true
+	}
+}
+
+// WithCABundle trusts the CA certificates in the PEM file at path, in
+// addition to the system ones, for the given registries, or for all
+// registries if none are given.
+func WithCABundle(path string, registries ...string) Option {
+	return func(s *Store) {
+		if len(registries) == 0 {
+			s.caBundles[""] = append(s.caBundles[""], path)
+		}
+		for _, registry := range registries {
+			registry = registryKey(registry)
+			s.caBundles[registry] = append(s.caBundles[registry], path)
+		}
+	}
+}
+
+// registryHost returns the registry of a prefix or location in the
+// registries config.
+func registryHost(location string) string {
+	return registryKey(strings.SplitN(location, "/", 2)[0])
+}
+
+// isInsecure returns whether the store may talk to registry insecurely.
+func (s *Store) isInsecure(registry string) bool {
+	return s.insecureRegistries[registry]
+}
+
+// withTransportSettings returns ref, parsed so that it is pulled over plain
+// HTTP if its registry is insecure.
+func (s *Store) withTransportSettings(ref name.Reference) (name.Reference, error) {
+	if !s.isInsecure(ref.Context().RegistryStr()) {
+		return ref, nil
+	}
+	return rewriteReference(ref, ref.Context().Name(), name.Insecure)
+}
+
+// newTransport returns the transport the store talks to registries with,
+// trusting the configured CA bundles, skipping verification for insecure
+// registries, retrying transient failures and keeping to the bandwidth limit.
+func (s *Store) newTransport() (http.RoundTripper, error) {
+	t := &registryTransport{
+		registries: map[string]http.RoundTripper{},
+	}
+
+	var err error
+	t.fallback, err = newRegistryTransport(s.caBundles[""], false)
+	if err != nil {
+		return nil, err
+	}
+
+	registries := map[string]bool{}
+	for registry := range s.insecureRegistries {
+		registries[registry] = true
+	}
+	for registry := range s.caBundles {
+		if registry != "" {
+			registries[registry] = true
+		}
+	}
+	for registry := range registries {
+		bundles := append(append([]string{}, s.caBundles[""]...), s.caBundles[registry]...)
+		t.registries[registry], err = newRegistryTransport(bundles, s.isInsecure(registry))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var rt http.RoundTripper = t
+	if s.metrics != nil {
+		rt = &countingTransport{
+			transport: rt,
+			metrics:   s.metrics,
+		}
+	}
+	rt = &retryTransport{
+		transport: rt,
+		policy:    s.retryPolicy,
+	}
+	if s.bandwidthLimit > 0 {
+		rt = &throttledTransport{
+			transport: rt,
+			limiter:   &rateLimiter{rate: s.bandwidthLimit},
+		}
+	}
+	return rt, nil
+}
+
+func newRegistryTransport(caBundles []string, insecure bool) (*http.Transport, error) {
+	t := remote.DefaultTransport.Clone()
+	if len(caBundles) == 0 && !insecure {
+		return t, nil
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	for _, p := range caBundles {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA bundle: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %q", p)
+		}
+	}
+	t.TLSClientConfig = &tls.Config{
+		RootCAs:            pool,
+		InsecureSkipVerify: insecure,
+	}
+	return t, nil
+}
+
+// registryTransport sends requests with the transport for the registry they
+// are for.
+type registryTransport struct {
+	registries map[string]http.RoundTripper
+	fallback   http.RoundTripper
+}
+
+func (t *registryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rt, ok := t.registries[req.URL.Host]; ok {
+		return rt.RoundTrip(req)
+	}
+	return t.fallback.RoundTrip(req)
+}
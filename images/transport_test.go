@@ -0,0 +1,114 @@
+package images
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestExtractOverTLS(t *testing.T) {
+	discard := log.New(ioutil.Discard, "", 0)
+	srv := httptest.NewUnstartedServer(registry.New(registry.Logger(discard)))
+	// Keep the TLS handshake errors of the failing cases out of the output.
+	srv.Config.ErrorLog = discard
+	srv.StartTLS()
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "https://")
+
+	caBundle := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(caBundle, cert, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := random.Image(1000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference(host + "/tls/image:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img, remote.WithTransport(srv.Client().Transport.(*http.Transport))); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		opts    []Option
+		wantErr bool
+	}{
+		{
+			name: "CA bundle for the registry",
+			opts: []Option{WithCABundle(caBundle, host)},
+		},
+		{
+			name: "CA bundle for all registries",
+			opts: []Option{WithCABundle(caBundle)},
+		},
+		{
+			name:    "CA bundle for another registry",
+			opts:    []Option{WithCABundle(caBundle, "registry.example.com")},
+			wantErr: true,
+		},
+		{
+			name:    "no CA bundle",
+			wantErr: true,
+		},
+		{
+			name: "insecure registry",
+			opts: []Option{WithInsecureRegistry(host)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewStore(t.TempDir(), tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = s.Extract(context.Background(), ref.String())
+			if tt.wantErr && err == nil {
+				t.Errorf("Extract succeeded, want an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Extract: %v", err)
+			}
+
+			// Extract falls back to plain HTTP for loopback registries, so
+			// check what fails over HTTPS is verifying the certificate.
+			transport, err := s.newTransport()
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/v2/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := transport.RoundTrip(req)
+			if err == nil {
+				resp.Body.Close()
+			}
+			var unknownAuthority x509.UnknownAuthorityError
+			if tt.wantErr && !errors.As(err, &unknownAuthority) {
+				t.Errorf("got %v over HTTPS, want an unknown authority error", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("got %v over HTTPS", err)
+			}
+		})
+	}
+}
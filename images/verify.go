@@ -0,0 +1,230 @@
+package images
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	cranev1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// signatureTagSuffix is the suffix of the tags cosign stores the
+	// signatures of an image under, as sha256-<hex>.sig.
+	signatureTagSuffix = ".sig"
+	// signatureAnnotation holds the base64 signature of a signature layer,
+	// which is a simple signing payload.
+	signatureAnnotation = "dev.cosignproject.cosign/signature"
+	// simpleSigningType is the type of the payloads cosign signs.
+	simpleSigningType = "cosign container image signature"
+	// maxPayloadSize bounds the signature payloads we read.
+	maxPayloadSize = 1 << 20
+)
+
+// simpleSigningPayload is the part of a signature payload we check.
+type simpleSigningPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// WithSignatureKeys makes Extract refuse images which are not signed, in the
+// way cosign signs them, with one of keys. ECDSA, RSA and Ed25519 keys are
+// supported. Signatures are checked when images are pulled; images in the
+// store which were not checked, such as imported ones, are pulled again.
+func WithSignatureKeys(keys ...crypto.PublicKey) Option {
+	return func(s *Store) {
+		s.signatureKeys = append(s.signatureKeys, keys...)
+	}
+}
+
+// LoadPublicKeys reads PEM encoded public keys, as written by
+// `cosign generate-key-pair`, for WithSignatureKeys.
+func LoadPublicKeys(paths ...string) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+	for _, p := range paths {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("error reading public key %q: %w", p, err)
+		}
+		key, err := ParsePublicKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing public key %q: %w", p, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// ParsePublicKey parses a PEM encoded public key.
+func ParsePublicKey(b []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+}
+
+// verifySignatures returns whether Extract only accepts signed images.
+func (s *Store) verifySignatures() bool {
+	return len(s.signatureKeys) != 0
+}
+
+// verifyImage checks that ref is signed with one of the store's keys. Either
+// the digest ref resolved to in the registry (remoteDigest) or, for a
+// multi-platform image, the digest of the image picked out of it may be
+// signed.
+//
+// The signature covers the manifest, which covers the config and through it
+// the diffIDs of the layers. The layers themselves may be shared with images
+// which were not verified, so this relies on layerStore.unpack checking
+// every layer against its diffID.
+func (s *Store) verifyImage(ctx context.Context, ref name.Reference, remoteDigest cranev1.Hash, img cranev1.Image) error {
+	digests := []cranev1.Hash{remoteDigest}
+	digest, err := img.Digest()
+	if err != nil {
+		return fmt.Errorf("error getting digest of image %s: %w", ref.Name(), err)
+	}
+	if digest != remoteDigest {
+		digests = append(digests, digest)
+	}
+
+	var errs []string
+	for _, digest := range digests {
+		err := s.verifyDigest(ctx, ref, digest)
+		if err == nil {
+			klog.Infof("verified signature of image %s@%s", ref.Name(), digest)
+			return nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return fmt.Errorf("image %s is not signed with a trusted key: %s", ref.Name(), strings.Join(errs, "; "))
+}
+
+// verifyDigest checks the signatures stored for digest in the repository of
+// ref, and returns nil if any of them is valid.
+func (s *Store) verifyDigest(ctx context.Context, ref name.Reference, digest cranev1.Hash) error {
+	sigRef := ref.Context().Tag(digest.Algorithm + "-" + digest.Hex + signatureTagSuffix)
+	sigImg, err := remote.Image(sigRef, s.remoteOptions(ctx)...)
+	if err != nil {
+		return fmt.Errorf("error fetching signatures %s: %w", sigRef, err)
+	}
+	manifest, err := sigImg.Manifest()
+	if err != nil {
+		return fmt.Errorf("error reading signatures %s: %w", sigRef, err)
+	}
+
+	for _, desc := range manifest.Layers {
+		sig, ok := desc.Annotations[signatureAnnotation]
+		if !ok {
+			continue
+		}
+		if desc.Size > maxPayloadSize {
+			klog.V(2).Infof("skipping signature %s of %s: payload of %d bytes is too large", desc.Digest, sigRef, desc.Size)
+			continue
+		}
+		layer, err := sigImg.LayerByDigest(desc.Digest)
+		if err != nil {
+			return fmt.Errorf("error reading signature %s of %s: %w", desc.Digest, sigRef, err)
+		}
+		payload, err := readPayload(layer)
+		if err != nil {
+			return fmt.Errorf("error reading signature %s of %s: %w", desc.Digest, sigRef, err)
+		}
+		if err := s.verifyPayload(payload, sig, digest); err != nil {
+			klog.V(2).Infof("signature %s of %s does not verify: %v", desc.Digest, sigRef, err)
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("no valid signature in %s", sigRef)
+}
+
+func readPayload(layer cranev1.Layer) ([]byte, error) {
+	rc, err := layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(io.LimitReader(rc, maxPayloadSize))
+}
+
+// verifyPayload checks that sig is a signature of payload by one of the
+// store's keys, and that the payload is about digest.
+func (s *Store) verifyPayload(payload []byte, sig string, digest cranev1.Hash) error {
+	rawSig, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	verified := false
+	for _, key := range s.signatureKeys {
+		if verifySignature(key, payload, rawSig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return errors.New("not signed with a trusted key")
+	}
+
+	// Only now that we know who wrote it do we look at what it says.
+	p := &simpleSigningPayload{}
+	if err := json.Unmarshal(payload, p); err != nil {
+		return fmt.Errorf("invalid payload: %w", err)
+	}
+	if p.Critical.Type != simpleSigningType {
+		return fmt.Errorf("unexpected payload type %q", p.Critical.Type)
+	}
+	if p.Critical.Image.DockerManifestDigest != digest.String() {
+		return fmt.Errorf("payload is for digest %q", p.Critical.Image.DockerManifestDigest)
+	}
+	return nil
+}
+
+// verifySignature returns whether sig is a signature of payload by key, made
+// the way cosign makes them: over the SHA-256 of the payload, with ASN.1
+// encoded ECDSA signatures and PKCS #1 v1.5 RSA signatures.
+func verifySignature(key crypto.PublicKey, payload []byte, sig []byte) bool {
+	h := sha256.Sum256(payload)
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, h[:], sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, h[:], sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, payload, sig)
+	default:
+		return false
+	}
+}
@@ -0,0 +1,211 @@
+package images
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	cranev1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+)
+
+// writeSignature stores a cosign signature by key of a payload saying that
+// ref is the image with the given digest, next to ref.
+func writeSignature(t *testing.T, ref name.Reference, signed cranev1.Hash, payloadDigest cranev1.Hash, key *ecdsa.PrivateKey) {
+	t.Helper()
+	payload := []byte(`{"critical":{"identity":{"docker-reference":"` + ref.Context().Name() + `"},` +
+		`"image":{"docker-manifest-digest":"` + payloadDigest.String() + `"},"type":"cosign container image signature"},"optional":null}`)
+	h := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := mutate.Append(empty.Image, mutate.Addendum{
+		Layer:       static.NewLayer(payload, "application/vnd.dev.cosign.simplesigning.v1+json"),
+		Annotations: map[string]string{signatureAnnotation: base64.StdEncoding.EncodeToString(sig)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref.Context().Tag(signed.Algorithm+"-"+signed.Hex+signatureTagSuffix), img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractVerifiesSignatures(t *testing.T) {
+	srv := httptest.NewServer(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	trusted, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	untrusted, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&trusted.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherDigest, err := other.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		// sign signs the image with the given digest, or leaves it
+		// unsigned.
+		sign    func(t *testing.T, ref name.Reference, digest cranev1.Hash)
+		wantErr bool
+	}{
+		{
+			name: "valid signature",
+			sign: func(t *testing.T, ref name.Reference, digest cranev1.Hash) {
+				writeSignature(t, ref, digest, digest, trusted)
+			},
+		},
+		{
+			name: "signed with another key",
+			sign: func(t *testing.T, ref name.Reference, digest cranev1.Hash) {
+				writeSignature(t, ref, digest, digest, untrusted)
+			},
+			wantErr: true,
+		},
+		{
+			name:    "unsigned",
+			sign:    func(t *testing.T, ref name.Reference, digest cranev1.Hash) {},
+			wantErr: true,
+		},
+		{
+			name: "payload for another digest",
+			sign: func(t *testing.T, ref name.Reference, digest cranev1.Hash) {
+				writeSignature(t, ref, digest, otherDigest, trusted)
+			},
+			wantErr: true,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := random.Image(1000, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			digest, err := img.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ref, err := name.ParseReference(host + "/verify/image" + string(rune('a'+i)) + ":v1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := remote.Write(ref, img); err != nil {
+				t.Fatal(err)
+			}
+			tt.sign(t, ref, digest)
+
+			s, err := NewStore(t.TempDir(), WithSignatureKeys(publicKey))
+			if err != nil {
+				t.Fatal(err)
+			}
+			extracted, err := s.Extract(context.Background(), ref.String())
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Extract succeeded, want an error")
+				}
+				if _, err := s.checkCached(context.Background(), ref, hostPlatform()); err == nil {
+					t.Errorf("image refused by Extract is in the store")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Extract: %v", err)
+			}
+			if !extracted.info.Verified {
+				t.Errorf("image is not recorded as verified")
+			}
+		})
+	}
+}
+
+func TestVerifiedImageSharingADiffIDWithAnUnsignedOne(t *testing.T) {
+	signedRef, unsignedRef := pushForgery(t,
+		newLayer(t, entry{name: "bin/"}, entry{name: "bin/tool", contents: "signed"}),
+		newLayer(t, entry{name: "bin/"}, entry{name: "bin/tool", contents: "unsigned"}))
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err := remote.Head(signedRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeSignature(t, signedRef, desc.Digest, desc.Digest, key)
+
+	// A store which does not check signatures shares its layers with one
+	// which does.
+	dir := t.TempDir()
+	unverified, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unverified.Extract(context.Background(), unsignedRef.String()); err == nil {
+		t.Errorf("Extract of the image with a forged diffID succeeded")
+	}
+
+	verified, err := NewStore(dir, WithSignatureKeys(publicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	extracted, err := verified.Extract(context.Background(), signedRef.String())
+	if err != nil {
+		t.Fatalf("Extract: %v", err)
+	}
+	if !extracted.info.Verified {
+		t.Errorf("image is not recorded as verified")
+	}
+	b, err := ioutil.ReadFile(filepath.Join(extracted.ExtractedDir, "bin", "tool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "signed" {
+		t.Errorf("bin/tool of the verified image has %q, want %q", b, "signed")
+	}
+}
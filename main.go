@@ -4,7 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"os"
+	"path/filepath"
 	"runtime"
+	"time"
 
 	"github.com/mengqiy/runc-poc/images"
 	"github.com/opencontainers/runc/libcontainer"
@@ -33,18 +35,87 @@ func main() {
 
 	// logrus.Info(*inConfigFile)
 
-	store, err := images.NewStore("/usr/local/google/home/mengqiy/.cache/runm")
+	config, err := getConfig()
 	if err != nil {
 		logrus.Fatal(err)
 		return
 	}
+
+	// Files in the image are owned by ids of the container's user namespace.
+	storeOptions := []images.Option{images.WithIDMappings(config.UidMappings, config.GidMappings)}
+	// Only run images signed with one of the given public keys.
+	if paths := os.Getenv("RUNM_SIGNATURE_KEYS"); paths != "" {
+		keys, err := images.LoadPublicKeys(filepath.SplitList(paths)...)
+		if err != nil {
+			logrus.Fatal(err)
+			return
+		}
+		storeOptions = append(storeOptions, images.WithSignatureKeys(keys...))
+	}
+	if path := os.Getenv("RUNM_REGISTRIES_CONFIG"); path != "" {
+		registries, err := images.LoadRegistriesConfig(path)
+		if err != nil {
+			logrus.Fatal(err)
+			return
+		}
+		storeOptions = append(storeOptions, images.WithRegistriesConfig(registries))
+	}
+	// Share identical files between layers: "hardlink" or "reflink".
+	if mode := os.Getenv("RUNM_DEDUP"); mode != "" {
+		storeOptions = append(storeOptions, images.WithDedup(images.DedupMode(mode)))
+	}
+	// Serve Prometheus metrics on e.g. "localhost:9090", and for
+	// RUNM_METRICS_LINGER (e.g. "30s") after the run, or write them to the
+	// RUNM_METRICS_TEXTFILE for the node exporter when the run is over.
+	var metrics *runMetrics
+	addr, textfile := os.Getenv("RUNM_METRICS_ADDR"), os.Getenv("RUNM_METRICS_TEXTFILE")
+	if addr != "" || textfile != "" {
+		var linger time.Duration
+		if value := os.Getenv("RUNM_METRICS_LINGER"); value != "" {
+			linger, err = time.ParseDuration(value)
+			if err != nil {
+				logrus.Fatalf("invalid RUNM_METRICS_LINGER: %v", err)
+				return
+			}
+		}
+		storeMetrics := images.NewMetrics()
+		metrics, err = newRunMetrics(textfile, linger, storeMetrics)
+		if err != nil {
+			logrus.Fatal(err)
+			return
+		}
+		if addr != "" {
+			if err := metrics.serve(addr); err != nil {
+				logrus.Fatal(err)
+				return
+			}
+		}
+		storeOptions = append(storeOptions, images.WithMetrics(storeMetrics))
+	}
+	store, err := images.NewStore("/usr/local/google/home/mengqiy/.cache/runm", storeOptions...)
+	if err != nil {
+		logrus.Fatal(err)
+		return
+	}
+
+	if len(os.Args) > 1 {
+		err := runCommand(context.Background(), store, os.Args[1:])
+		metrics.flush()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	}
+
 	// imgs, err := store.Pull("alpine:3.15.0", "linux", "amd64")
 	// if err != nil {
 	// 	logrus.Fatal(err)
 	// 	return
 	// }
-	extractedImage, err := store.Extract(context.Background(), "gcr.io/kpt-fn/gatekeeper:v0")
+	extractedImage, err := store.Extract(context.Background(), "gcr.io/kpt-fn/gatekeeper:v0",
+		images.WithProgress(images.NewProgressBar(os.Stderr)))
 	if err != nil {
+		metrics.flush()
 		logrus.Fatal(err)
 		return
 	}
@@ -66,11 +137,7 @@ func main() {
 	// config := GetConfig(devicesRules)
 
 	// config, err := getConfig(false, extractedImage.ExtractedDir)
-	config, err := getConfig(extractedImage.ExtractedDir)
-	if err != nil {
-		logrus.Fatal(err)
-		return
-	}
+	config.Rootfs = extractedImage.ExtractedDir
 
 	container, err := factory.Create("mycontainerid", config)
 	if err != nil {
@@ -88,24 +155,30 @@ func main() {
 		Init:   true,
 	}
 
+	start := time.Now()
 	err = container.Run(process)
 	if err != nil {
+		recordRun(start, nil)
 		container.Destroy()
+		metrics.flush()
 		logrus.Fatal(err)
 		return
 	}
 
 	// wait for the process to finish.
-	_, err = process.Wait()
+	state, err := process.Wait()
+	recordRun(start, state)
 	if err != nil {
+		metrics.flush()
 		logrus.Fatal(err)
 	}
 
 	// destroy the container.
 	container.Destroy()
+	metrics.flush()
 }
 
-func getConfig(rootfs string) (*configs.Config, error) {
+func getConfig() (*configs.Config, error) {
 	// in, err := ioutil.ReadFile(inputPath)
 	// if err != nil {
 	// 	return nil, err
@@ -115,7 +188,6 @@ func getConfig(rootfs string) (*configs.Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	config.Rootfs = rootfs
 	return &config, nil
 }
 
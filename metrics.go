@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	runDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "runm",
+		Subsystem: "container",
+		Name:      "run_duration_seconds",
+		Help:      "Time from starting a container to its process exiting.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 16),
+	})
+	runExits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "runm",
+		Subsystem: "container",
+		Name:      "runs_total",
+		Help:      "Container runs, by the exit code of their process, or the signal which killed it.",
+	}, []string{"exit_code", "signal"})
+)
+
+// recordRun records a container run which started at start and ended in
+// state, which is nil if the process could not be waited for.
+func recordRun(start time.Time, state *os.ProcessState) {
+	runDuration.Observe(time.Since(start).Seconds())
+	runExits.WithLabelValues(exitLabels(state)...).Inc()
+}
+
+// exitLabels returns the exit_code and signal labels of a run which ended in
+// state.
+func exitLabels(state *os.ProcessState) []string {
+	if state == nil {
+		return []string{"unknown", ""}
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		signal := unix.SignalName(status.Signal())
+		if signal == "" {
+			signal = strconv.Itoa(int(status.Signal()))
+		}
+		return []string{"", signal}
+	}
+	return []string{strconv.Itoa(state.ExitCode()), ""}
+}
+
+// runMetrics publishes the run metrics along with the metrics of the store.
+// The process exits right after the run, before anything is likely to scrape
+// them, so they are kept being served for linger afterwards, and written to
+// textfile for the node exporter's textfile collector.
+type runMetrics struct {
+	// registry has the metrics of the run, which are written to textfile.
+	// The Go and process metrics are only served.
+	registry *prometheus.Registry
+	serving  bool
+	textfile string
+	linger   time.Duration
+}
+
+func newRunMetrics(textfile string, linger time.Duration, collectors ...prometheus.Collector) (*runMetrics, error) {
+	registry := prometheus.NewRegistry()
+	collectors = append(collectors, runDuration, runExits)
+	for _, c := range collectors {
+		if err := registry.Register(c); err != nil {
+			return nil, fmt.Errorf("failed to register metrics: %w", err)
+		}
+	}
+	return &runMetrics{
+		registry: registry,
+		textfile: textfile,
+		linger:   linger,
+	}, nil
+}
+
+// serve serves the metrics on http://addr/metrics, in the background.
+func (m *runMetrics) serve(addr string) error {
+	process := prometheus.NewRegistry()
+	process.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s for metrics: %w", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(prometheus.Gatherers{m.registry, process}, promhttp.HandlerOpts{}))
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			logrus.Errorf("serving metrics on %s: %v", addr, err)
+		}
+	}()
+	m.serving = true
+	logrus.Infof("serving metrics on http://%s/metrics", l.Addr())
+	return nil
+}
+
+// flush publishes the metrics before the process exits: it writes them to
+// the textfile, and keeps serving them for the linger period.
+func (m *runMetrics) flush() {
+	if m == nil {
+		return
+	}
+	if m.textfile != "" {
+		if err := prometheus.WriteToTextfile(m.textfile, m.registry); err != nil {
+			logrus.Errorf("writing metrics to %s: %v", m.textfile, err)
+		}
+	}
+	if m.serving && m.linger > 0 {
+		logrus.Infof("serving metrics for another %s", m.linger)
+		time.Sleep(m.linger)
+	}
+}